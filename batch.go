@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pgaskin/kfwproxy/proxy"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+// batchKey is the type of the context key used to prevent batch recursion.
+type batchKey string
+
+const batched = batchKey("batched")
+
+// batchHandler handles batch requests to hdl (see the README).
+func batchHandler(hdl http.Handler, hm *metrics.Set, corsOrigin []string, maxAge int, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var log zerolog.Logger
+		if hl := hlog.FromRequest(r); hl != nil {
+			log = hl.With().Str("component", "batch").Logger()
+		} else {
+			log = zerolog.Nop()
+		}
+
+		w.Header().Set("Server", "kfwproxy")
+		w.Header().Set("X-KFWProxy-Batch-Version", "1") // increment when the response format changes
+		proxy.SetCORSOrigin(w, r, corsOrigin)
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+		w.Header().Set("Access-Control-Expose-Headers", "X-KFWProxy-Request-ID, X-KFWProxy-Batch-Version")
+
+		if r.Context().Value(batched) != nil {
+			log.Warn().Msg("recursive batch")
+			hm.GetOrCreateCounter("kfwproxy_batch_recursion_blocked_total").Inc()
+			http.Error(w, "Batch recursion not allowed", http.StatusForbidden)
+			return
+		}
+
+		xs := r.URL.Query()["x"]
+		if len(xs) == 0 {
+			http.Error(w, "Parameter x[] missing for batch GET", http.StatusBadRequest)
+			return
+		}
+		if len(xs) > batchLimit {
+			log.Warn().Msg("too many requests in batch GET")
+			hm.GetOrCreateCounter("kfwproxy_batch_too_many_total").Inc()
+			http.Error(w, "Too many requests in batch GET", http.StatusForbidden)
+			return
+		}
+
+		hd := r.URL.Query().Get("h")
+		if hd != "" && hd != "1" {
+			http.Error(w, "Parameter h must be 1 or unset for batch GET", http.StatusBadRequest)
+			return
+		}
+
+		log.Info().Int("n", len(xs)).Msg("processing batch request")
+
+		res := make([]struct {
+			Status int                 `json:"status"`
+			Header map[string][]string `json:"header,omitempty"`
+			Body   string              `json:"body"`
+			Error  string              `json:"error,omitempty"` // set instead of the body if the proxy itself failed
+		}, len(xs))
+
+		bc := batchCache{MaxAge: maxAge}
+
+		ctx, cancel := context.WithTimeout(context.WithValue(r.Context(), batched, true), timeout)
+		defer cancel()
+
+		for i, x := range xs {
+			x = "/api.kobobooks.com/" + strings.TrimPrefix(x, "/")
+
+			if ctx.Err() != nil {
+				log.Warn().Str("url", x).Msg("batch deadline exceeded before request")
+				res[i].Status, res[i].Error = http.StatusGatewayTimeout, "timeout"
+				bc.NoCache = true
+				continue
+			}
+
+			rc := httptest.NewRecorder()
+			rq, err := http.NewRequestWithContext(ctx, "GET", x, nil)
+			if err != nil {
+				res[i].Status = http.StatusBadRequest
+				res[i].Error = err.Error()
+				continue
+			}
+
+			hdl.ServeHTTP(rc, rq)
+
+			// the request was cut short by the deadline
+			if rc.Code != http.StatusOK && ctx.Err() != nil {
+				log.Warn().Str("url", x).Int("status", rc.Code).Msg("batch deadline exceeded during request")
+				res[i].Status, res[i].Error = http.StatusGatewayTimeout, "timeout"
+				bc.NoCache = true
+				continue
+			}
+
+			bc.Add(rc.Code, rc.HeaderMap)
+
+			res[i].Status = rc.Code
+			if hd == "1" {
+				res[i].Header = rc.HeaderMap
+			}
+			res[i].Body = rc.Body.String() // note: if binary responses are added anywhere in the future, it will need to be checked and return an error instead
+		}
+
+		bc.SetHeaders(w.Header(), time.Now())
+
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(res)
+
+		hm.GetOrCreateHistogram("kfwproxy_batch_response_size_bytes").Update(float64(buf.Len()))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf.Bytes())
+	})
+}
+
+// batchCache computes the caching headers for a batch response. The batch is
+// cached for the minimum max-age of the responses in it (starting at MaxAge)
+// if all of them were successful.
+type batchCache struct {
+	MaxAge  int
+	NoCache bool
+}
+
+// Add updates the max-age for a response in the batch.
+func (b *batchCache) Add(status int, hdr http.Header) {
+	if b.NoCache {
+		return
+	}
+	if status != http.StatusOK {
+		b.NoCache = true
+	} else if cc := hdr.Get("Cache-Control"); cc != "" { // kfwproxy endpoints return Cache-Control or nothing, so we don't need to handle Expires or the other ones
+		for _, ccs := range strings.Split(cc, ",") {
+			if d := strings.TrimSpace(ccs); d == "no-cache" || d == "no-store" {
+				b.NoCache = true // e.g. stale or uncacheable responses
+			} else if strings.HasPrefix(d, "max-age=") {
+				if c, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(ccs, "=", 2)[1])); err != nil {
+					continue
+				} else {
+					if c <= 0 {
+						b.NoCache = true
+					} else if c < b.MaxAge {
+						b.MaxAge = c
+					}
+				}
+			}
+		}
+	}
+}
+
+// SetHeaders sets the caching headers for the batch response.
+func (b *batchCache) SetHeaders(h http.Header, now time.Time) {
+	if b.NoCache {
+		h.Set("Cache-Control", "no-cache")
+		h.Set("Pragma", "no-cache")
+		h.Set("Expires", "0")
+	} else {
+		h.Set("Cache-Control", "max-age="+strconv.Itoa(b.MaxAge))
+		h.Set("Expires", now.Add(time.Duration(b.MaxAge)*time.Second).Format(http.TimeFormat))
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+func TestBatchCache(t *testing.T) {
+	type resp struct {
+		status int
+		cc     string
+	}
+	for _, tc := range []struct {
+		name  string
+		resps []resp
+		cc    string // expected Cache-Control
+	}{
+		{"AllDefault", []resp{{200, ""}, {200, ""}}, "max-age=900"},
+		{"Single", []resp{{200, "max-age=60"}}, "max-age=60"},
+		{"Minimum", []resp{{200, "max-age=600"}, {200, "max-age=30"}, {200, "max-age=120"}}, "max-age=30"},
+		{"LongerThanDefault", []resp{{200, "max-age=3600"}}, "max-age=900"},
+		{"MixedDefault", []resp{{200, ""}, {200, "max-age=300"}}, "max-age=300"},
+		{"OtherDirectives", []resp{{200, "public, max-age=45, must-revalidate"}}, "max-age=45"},
+		{"Spaces", []resp{{200, "public,  max-age= 50 "}}, "max-age=50"},
+		{"InvalidMaxAge", []resp{{200, "max-age=abc"}, {200, "max-age=100"}}, "max-age=100"},
+		{"NoCacheOnly", []resp{{200, "no-cache"}}, "no-cache"},
+		{"NoStore", []resp{{200, "max-age=60"}, {200, "no-store"}}, "no-cache"},
+		{"ZeroMaxAge", []resp{{200, "max-age=60"}, {200, "max-age=0"}}, "no-cache"},
+		{"NegativeMaxAge", []resp{{200, "max-age=-1"}}, "no-cache"},
+		{"NotFound", []resp{{200, "max-age=60"}, {404, "no-cache"}}, "no-cache"},
+		{"BadGateway", []resp{{502, ""}, {200, "max-age=60"}}, "no-cache"},
+		{"NotModified", []resp{{304, "max-age=60"}}, "no-cache"},
+		{"Empty", nil, "max-age=900"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bc := batchCache{MaxAge: 900}
+			for _, r := range tc.resps {
+				h := http.Header{}
+				if r.cc != "" {
+					h.Set("Cache-Control", r.cc)
+				}
+				bc.Add(r.status, h)
+			}
+
+			now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			h := http.Header{}
+			bc.SetHeaders(h, now)
+
+			if v := h.Get("Cache-Control"); v != tc.cc {
+				t.Errorf("expected Cache-Control %q, got %q", tc.cc, v)
+			}
+			if tc.cc == "no-cache" {
+				if v := h.Get("Pragma"); v != "no-cache" {
+					t.Errorf("expected Pragma no-cache, got %q", v)
+				}
+				if v := h.Get("Expires"); v != "0" {
+					t.Errorf("expected Expires 0, got %q", v)
+				}
+			} else {
+				if v := h.Get("Pragma"); v != "" {
+					t.Errorf("expected no Pragma, got %q", v)
+				}
+				if exp, err := http.ParseTime(h.Get("Expires")); err != nil {
+					t.Errorf("invalid Expires %q: %v", h.Get("Expires"), err)
+				} else if d := exp.Sub(now); "max-age="+strconv.Itoa(int(d.Seconds())) != tc.cc {
+					t.Errorf("expected Expires to match %q, got %s from now", tc.cc, d)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchHandlerTimeout(t *testing.T) {
+	hdl := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api.kobobooks.com/slow" {
+			select {
+			case <-r.Context().Done():
+				http.Error(w, r.Context().Err().Error(), http.StatusBadGateway)
+				return
+			case <-time.After(time.Second * 5):
+			}
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	})
+	h := batchHandler(hdl, metrics.NewSet(), []string{"*"}, 900, time.Millisecond*50)
+
+	rc := httptest.NewRecorder()
+	h.ServeHTTP(rc, httptest.NewRequest("GET", "/api.kobobooks.com?x=fast&x=slow&x=fast", nil))
+	if rc.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rc.Code)
+	}
+
+	var res []struct {
+		Status int    `json:"status"`
+		Body   string `json:"body"`
+		Error  string `json:"error"`
+	}
+	if err := json.Unmarshal(rc.Body.Bytes(), &res); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(res) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(res))
+	}
+	if res[0].Status != http.StatusOK || res[0].Body != "ok" {
+		t.Errorf("expected the first entry to succeed, got %d %q", res[0].Status, res[0].Body)
+	}
+	for i := 1; i < 3; i++ { // during, then before
+		if res[i].Status != http.StatusGatewayTimeout || res[i].Error != "timeout" {
+			t.Errorf("expected entry %d to time out, got %d %q", i, res[i].Status, res[i].Error)
+		}
+	}
+	if v := rc.Header().Get("Cache-Control"); v != "no-cache" {
+		t.Errorf("expected Cache-Control no-cache, got %q", v)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientKey returns a normalized key identifying the client which made the
+// request (e.g. for rate limiting). X-Forwarded-For is only honored if the
+// request came from one of the trusted proxies, in which case the rightmost
+// untrusted address is used.
+//
+// IPv6 addresses are bucketed by /64, since clients usually get an entire /64
+// and can rotate addresses within it freely (and would otherwise be able to
+// evade per-IP limits).
+func ClientKey(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+
+	if ipTrusted(ip, trusted) {
+		xff := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(xff) - 1; i >= 0; i-- {
+			xip := net.ParseIP(strings.TrimSpace(xff[i]))
+			if xip == nil {
+				break
+			}
+			ip = xip
+			if !ipTrusted(xip, trusted) {
+				break
+			}
+		}
+	}
+
+	if ip.To4() == nil {
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+	}
+	return ip.String()
+}
+
+func ipTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Features is the set of enabled optional subsystems.
+type Features map[string]bool
+
+// FeatureNames describes the optional subsystems which can be toggled with
+// --features.
+var FeatureNames = map[string]string{
+	"admin":     "the /admin endpoints (requires admin-token)",
+	"batch":     "batch requests to /api.kobobooks.com",
+	"latest":    "the /latest endpoints (version, badges, notes, history, and feeds) and notifications",
+	"poller":    "the active poller (requires poll-target)",
+	"pprof":     "the /debug/pprof endpoints (requires admin-token)",
+	"root-page": "the page at / (instead of redirecting to GitHub)",
+	"stats":     "the cache statistics at /stats",
+}
+
+// ParseFeatures applies a list of feature names (optionally prefixed with + to
+// enable or - to disable them) to the defaults. Unknown names are an error.
+func ParseFeatures(defaults Features, list []string) (Features, error) {
+	f := make(Features, len(FeatureNames))
+	for n := range FeatureNames {
+		f[n] = defaults[n]
+	}
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		en := !strings.HasPrefix(v, "-")
+		n := strings.TrimLeft(v, "+-")
+		if _, ok := FeatureNames[n]; !ok {
+			return nil, fmt.Errorf("unknown feature %#v (known: %s)", n, strings.Join(featureNames(), ", "))
+		}
+		f[n] = en
+	}
+	return f, nil
+}
+
+// featureNames returns all known feature names, sorted.
+func featureNames() []string {
+	ns := make([]string, 0, len(FeatureNames))
+	for n := range FeatureNames {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+// Enabled returns the enabled feature names, sorted.
+func (f Features) Enabled() []string {
+	var ns []string
+	for _, n := range featureNames() {
+		if f[n] {
+			ns = append(ns, n)
+		}
+	}
+	return ns
+}
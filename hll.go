@@ -0,0 +1,64 @@
+package main
+
+import (
+	"hash/maphash"
+	"math"
+	"math/bits"
+	"sync"
+)
+
+// hllP is the HyperLogLog precision. The standard error is 1.04/sqrt(2^p), so
+// 14 gives ~0.8% using 16 KiB.
+const hllP = 14
+
+// HyperLogLog estimates the number of distinct strings added to it using a
+// fixed amount of memory. The strings themselves are not stored.
+type HyperLogLog struct {
+	m sync.Mutex
+	s maphash.Seed
+	r [1 << hllP]uint8
+}
+
+// NewHyperLogLog creates a new empty HyperLogLog.
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{s: maphash.MakeSeed()}
+}
+
+// Add adds s to the set.
+func (h *HyperLogLog) Add(s string) {
+	var mh maphash.Hash
+	mh.SetSeed(h.s)
+	mh.WriteString(s)
+	x := mh.Sum64()
+
+	i := x >> (64 - hllP)
+	r := uint8(bits.LeadingZeros64(x<<hllP|1<<(hllP-1)) + 1)
+
+	h.m.Lock()
+	if r > h.r[i] {
+		h.r[i] = r
+	}
+	h.m.Unlock()
+}
+
+// Estimate returns the approximate number of distinct strings added.
+func (h *HyperLogLog) Estimate() uint64 {
+	const m = float64(len(h.r))
+
+	var sum float64
+	var zeros int
+	h.m.Lock()
+	for _, r := range h.r {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	h.m.Unlock()
+
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros != 0 {
+		e = m * math.Log(m/float64(zeros)) // linear counting for small cardinalities
+	}
+	return uint64(e + 0.5)
+}
@@ -1,54 +1,210 @@
 package main
 
 import (
-	"context"
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	htmltemplate "html/template"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
-	"net/http/httptest"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"path"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
 	"github.com/VictoriaMetrics/metrics"
 	"github.com/julienschmidt/httprouter"
+	"github.com/pgaskin/kfwproxy/latest"
+	"github.com/pgaskin/kfwproxy/proxy"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 	"github.com/spf13/pflag"
 )
 
+// batchLimit is the maximum number of requests in a batch.
+const batchLimit = 20
+
+// The built-in Kobo API routes (proxy-route must not conflict with them).
+const (
+	upgradeCheckRoute = "/api.kobobooks.com/1.0/UpgradeCheck/Device/:device/:affiliate/:version/:serial"
+	releaseNotesRoute = "/api.kobobooks.com/1.0/ReleaseNotes/:idx"
+)
+
 func main() {
-	addr := pflag.StringP("addr", "a", ":8080", "the address to listen on")
+	addr := pflag.StringP("addr", "a", ":8080", "the address to listen on (or unix:/path/to/socket for a unix socket)")
 	timeout := pflag.DurationP("timeout", "t", time.Second*4, "timeout for proxied requests")
+	upstreamMaxIdleConns := pflag.Int("upstream-max-idle-conns", 100, "the maximum number of idle keep-alive connections to upstream servers (0 for unlimited)")
+	upstreamMaxIdleConnsPerHost := pflag.Int("upstream-max-idle-conns-per-host", 32, "the maximum number of idle keep-alive connections per upstream host")
+	upstreamMaxConnsPerHost := pflag.Int("upstream-max-conns-per-host", 0, "the maximum number of connections per upstream host, including active ones (0 for unlimited)")
+	upstreamConcurrency := pflag.Int("upstream-concurrency", 0, "the maximum number of concurrent upstream requests, with further ones waiting for a slot (0 for unlimited)")
+	upstreamHTTP2 := pflag.Bool("upstream-http2", true, "use HTTP/2 for upstream connections if supported")
+	readTimeout := pflag.Duration("read-timeout", time.Second*10, "timeout for reading client requests")
+	writeTimeout := pflag.Duration("write-timeout", time.Second*30, "timeout for writing responses to clients (should be longer than timeout and batch-timeout)")
+	idleTimeout := pflag.Duration("idle-timeout", time.Second*120, "timeout for idle keep-alive client connections")
 	cacheLimit := pflag.Int64P("cache-limit", "l", 50, "limit for cache size in MB")
+	cacheCounters := pflag.Int64("cache-counters", 0, "number of ristretto frequency counters, ideally 10x the expected number of cached items (0 to derive from cache-limit)")
+	cacheBufferItems := pflag.Int64("cache-buffer-items", 64, "number of keys per ristretto Get buffer (the default is usually fine)")
+	cacheShards := pflag.Int("cache-shards", 1, "number of ristretto caches to split the cache-limit and cache-counters across to reduce contention at very high request rates")
+	cacheRetain := pflag.Duration("cache-retain", 0, "how long to keep expired cache entries for revalidation using Last-Modified")
+	staleIfErrorMax := pflag.Duration("stale-if-error-max", 0, "how long after expiry to serve cached responses if upstream fails (also extends cache-retain if longer)")
 	cacheTime := pflag.DurationP("cache-time", "T", time.Hour/4, "how long to cache upgrade info for")
+	proxyRoute := pflag.StringArray("proxy-route", nil, "additional read-only Kobo API routes to proxy, in the httprouter format (can be specified multiple times) (format: /api.kobobooks.com/1.0/Path/:param=ttl, or =stream to pass large responses through without caching them)")
+	cacheWeight := pflag.StringArray("cache-weight", nil, "multiply the cache cost of a route's entries so they are more (< 1) or less (> 1) likely to stay in the cache (the cache-limit will be less accurate) (format: route=weight, where the route is upgradecheck, releasenotes, or a proxy-route pattern)")
+	maintenance := pflag.Bool("maintenance", false, "only serve cached responses and never make upstream requests (can also be toggled using /admin/maintenance)")
+	batchTimeout := pflag.Duration("batch-timeout", time.Second*10, "overall deadline for batch requests (entries which aren't finished by then are returned as errors)")
+	breakerThreshold := pflag.Int("breaker-threshold", 5, "number of consecutive upstream failures before failing fast (0 to disable)")
+	breakerCooldown := pflag.Duration("breaker-cooldown", time.Second*30, "how long to fail fast for before retrying upstream")
+	pollTarget := pflag.StringSlice("poll-target", nil, "the devices to actively poll for upgrades, so the latest versions stay fresh without client traffic (format: device/affiliate/version/serial)")
+	pollInterval := pflag.Duration("poll-interval", time.Hour, "how often to poll for upgrades (requires poll-target)")
+	versionRegex := pflag.String("version-regex", latest.VersionPattern, "the regexp for extracting versions from upgrade URLs (must have 2 or 3 capture groups matching the version components)")
+	historySize := pflag.Int("history-size", 100, "the maximum number of versions to keep in the history (0 for unlimited)")
+	historyMaxAge := pflag.Duration("history-max-age", 0, "the maximum age of versions to keep in the history (0 for unlimited)")
+	legacyVersionMetrics := pflag.Bool("legacy-version-metrics", true, "also export the kfwproxy_latest_version and kfwproxy_latest_device_version gauges (deprecated, use the _info metrics instead)")
+	notifyConcurrency := pflag.Int("notify-concurrency", 0, "the maximum number of notifiers to run at once (0 for unlimited)")
+	notifyRetries := pflag.Int("notify-retries", 3, "the number of times to retry a notifier which failed completely (on the next notify-debounce interval)")
+	svgMaxAge := pflag.Duration("svg-max-age", time.Minute, "allow clients to cache /latest/version/svg for this long if requested with ?nocache=0 and badge-max-age is not set")
+	badgeMaxAge := pflag.Duration("badge-max-age", 0, "allow clients to cache the badges for this long, revalidating them using an ETag (0 to disable caching)")
+	badgePrefix := pflag.String("badge-prefix", "", "the default text to show before the version in the SVG and PNG badges")
+	notifyReplay := pflag.Bool("notify-replay", false, "send the last announced version (not including the one seen at startup) to notifiers which finish initializing after it")
+	notifyDebounce := pflag.Duration("notify-debounce", time.Second*5, "how often to check for new versions to notify about (larger values reduce false positives during staged rollouts, but delay notifications)")
 	telegramBot := pflag.StringP("telegram-bot", "B", "", "the Telegram bot token (to enable notifications) (requires telegram-chat)")
+	telegramBotFile := pflag.String("telegram-bot-file", "", "read the Telegram bot token from a file instead (mutually exclusive with telegram-bot)")
 	telegramChat := pflag.StringSliceP("telegram-chat", "b", nil, "the Telegram chat IDs to send messages to (find it using @IDBot) (can also specify a channel in the format @ChannelUsername) (requires telegram-bot)")
+	telegramNotesUpdates := pflag.Bool("telegram-notes-updates", false, "also send Telegram messages when the release notes are updated without a new version")
+	telegramButtons := pflag.Bool("telegram-buttons", false, "add buttons linking to the release notes, download, and more information to Telegram messages")
+	telegramParseMode := pflag.String("telegram-parse-mode", "HTML", "the format to send Telegram messages in (HTML or MarkdownV2)")
+	telegramAPIBase := pflag.String("telegram-api-base", TelegramAPIBase, "the base URL of the Telegram Bot API (e.g. for a local Bot API server)")
+	telegramLinkPreview := pflag.Bool("telegram-link-preview", false, "show a link preview in Telegram messages")
+	telegramTimeout := pflag.Duration("telegram-timeout", time.Second*10, "timeout for Telegram API requests")
+	telegramChatDevices := pflag.StringSlice("telegram-chat-devices", nil, "only send Telegram messages to a chat for versions released for a device ID matching the pattern (can be specified multiple times per chat) (format: chat=pattern)")
 	telegramForce := pflag.StringSlice("telegram-force", nil, "send Telegram messages to these chats even if the original version is zero (for debugging only)")
 	mobilereadUser := pflag.StringP("mobileread-user", "M", "", "the MobileRead credentials (to enable notifications) (requires mobileread-forum) (format: username:password)")
+	mobilereadUserFile := pflag.String("mobileread-user-file", "", "read the MobileRead credentials from a file instead (mutually exclusive with mobileread-user)")
 	mobilereadForum := pflag.IntSliceP("mobileread-forum", "m", nil, "the MobileRead forum IDs to post threads to (requires mobileread-username and mobileread-password)")
+	mobilereadTimeout := pflag.Duration("mobileread-timeout", time.Second*30, "timeout for MobileRead requests (posting threads can be slow)")
+	mobilereadSubject := pflag.String("mobileread-subject-template", MobileReadSubjectTemplate, "the Go template for MobileRead thread subjects")
+	mobilereadTags := pflag.String("mobileread-tags", MobileReadTags, "the comma-separated tags for MobileRead threads")
+	mobilereadSignature := pflag.String("mobileread-signature", MobileReadSignature, "the BBCode signature to append to MobileRead threads (empty to omit)")
+	mobilereadRefresh := pflag.Duration("mobileread-refresh", time.Hour*6, "how often to refresh the MobileRead session (0 to disable)")
+	mobilereadForumDevices := pflag.StringSlice("mobileread-forum-devices", nil, "only post MobileRead threads to a forum for versions released for a device ID matching the pattern (can be specified multiple times per forum) (format: forum=pattern)")
 	mobilereadForce := pflag.IntSlice("mobileread-force", nil, "post MobileRead threads to these chats even if the original version is zero (for debugging only)")
-	logJSON := pflag.BoolP("log-json", "j", false, "use JSON for logs")
+	logJSON := pflag.BoolP("log-json", "j", false, "use JSON for logs (same as --log-format=json)")
+	logFormat := pflag.String("log-format", "console", "log format (console, json, ecs)")
+	accessLogSample := pflag.Uint64("access-log-sample", 1, "log 1 in N successful requests at info level (the rest are logged at debug level) (errors are always logged) (0 to log all at debug level)")
 	logLevel := pflag.IntP("log-level", "v", 1, "log level (0=debug, 1=info, 2=warn, 3=error)")
+	gzipLevel := pflag.Int("gzip-level", gzip.DefaultCompression, "the gzip compression level for compressed responses (-1 for the default, 1-9)")
+	maxURLLength := pflag.Int("max-url-length", 2048, "the maximum request URL length (longer requests are rejected with 414)")
+	maxHeaderBytes := pflag.Int("max-header-bytes", 16384, "the maximum total size of the request headers (larger requests are rejected with 431)")
+	corsOrigin := pflag.StringSlice("cors-origin", []string{"*"}, "the origins allowed to make cross-origin requests (* for any)")
+	trustedProxies := pflag.StringSlice("trusted-proxies", nil, "the CIDRs of reverse proxies to trust X-Forwarded-For from when identifying clients")
+	rootPage := pflag.Bool("root-page", false, "serve a page with the latest version and links to the endpoints at / instead of redirecting to GitHub")
+	rootPageTemplate := pflag.String("root-page-template", "", "a Go html/template file to use for the root page instead of the default one (requires root-page)")
+	robotsTxt := pflag.String("robots-txt", "", "a file to serve as /robots.txt instead of the default one")
+	stats := pflag.Bool("stats", true, "serve cache statistics at /stats")
+	adminToken := pflag.String("admin-token", "", "the bearer token (or basic auth password) for the /admin endpoints (to enable them)")
+	pprofEnabled := pflag.Bool("pprof", false, "serve the Go profiling endpoints at /debug/pprof/ (requires admin-token)")
+	internalAuth := pflag.Bool("internal-auth", false, "also require the admin-token for /stats and /metrics (requires admin-token)")
+	mockUpgradeCheck := pflag.String("mock-upgradecheck", "", "serve the upgrade check response from this JSON file instead of making upstream requests (for testing)")
+	simulateLatency := pflag.String("simulate-latency", "", "delay proxied responses by a fixed or random duration (for testing clients only) (format: 100ms or 100ms-1s)")
+	featureList := pflag.StringSlice("features", nil, "optional subsystems to enable, or disable if prefixed with - (overrides the individual flags) (known: "+strings.Join(featureNames(), ", ")+")")
 	help := pflag.BoolP("help", "h", false, "show this help text")
 
+	pflag.CommandLine.MarkHidden("simulate-latency")
+
 	envmap := map[string]string{
-		"addr":             "KFWPROXY_ADDR",
-		"timeout":          "KFWPROXY_TIMEOUT",
-		"cache-limit":      "KFWPROXY_CACHE_LIMIT",
-		"cache-time":       "KFWPROXY_CACHE_TIME",
-		"telegram-bot":     "KFWPROXY_TELEGRAM_BOT",
-		"telegram-chat":    "KFWPROXY_TELEGRAM_CHAT",
-		"telegram-force":   "KFWPROXY_TELEGRAM_FORCE",
-		"mobileread-user":  "KFWPROXY_MOBILEREAD_USER",
-		"mobileread-forum": "KFWPROXY_MOBILEREAD_FORUM",
-		"mobileread-force": "KFWPROXY_MOBILEREAD_FORCE",
-		"log-json":         "KFWPROXY_LOG_JSON",
-		"log-level":        "KFWPROXY_LOG_LEVEL",
+		"addr":                             "KFWPROXY_ADDR",
+		"timeout":                          "KFWPROXY_TIMEOUT",
+		"upstream-max-idle-conns":          "KFWPROXY_UPSTREAM_MAX_IDLE_CONNS",
+		"upstream-max-idle-conns-per-host": "KFWPROXY_UPSTREAM_MAX_IDLE_CONNS_PER_HOST",
+		"upstream-max-conns-per-host":      "KFWPROXY_UPSTREAM_MAX_CONNS_PER_HOST",
+		"upstream-http2":                   "KFWPROXY_UPSTREAM_HTTP2",
+		"upstream-concurrency":             "KFWPROXY_UPSTREAM_CONCURRENCY",
+		"read-timeout":                     "KFWPROXY_READ_TIMEOUT",
+		"write-timeout":                    "KFWPROXY_WRITE_TIMEOUT",
+		"idle-timeout":                     "KFWPROXY_IDLE_TIMEOUT",
+		"cache-limit":                      "KFWPROXY_CACHE_LIMIT",
+		"cache-counters":                   "KFWPROXY_CACHE_COUNTERS",
+		"cache-buffer-items":               "KFWPROXY_CACHE_BUFFER_ITEMS",
+		"cache-shards":                     "KFWPROXY_CACHE_SHARDS",
+		"cache-retain":                     "KFWPROXY_CACHE_RETAIN",
+		"stale-if-error-max":               "KFWPROXY_STALE_IF_ERROR_MAX",
+		"cache-time":                       "KFWPROXY_CACHE_TIME",
+		"proxy-route":                      "KFWPROXY_PROXY_ROUTE",
+		"cache-weight":                     "KFWPROXY_CACHE_WEIGHT",
+		"maintenance":                      "KFWPROXY_MAINTENANCE",
+		"batch-timeout":                    "KFWPROXY_BATCH_TIMEOUT",
+		"breaker-threshold":                "KFWPROXY_BREAKER_THRESHOLD",
+		"breaker-cooldown":                 "KFWPROXY_BREAKER_COOLDOWN",
+		"poll-target":                      "KFWPROXY_POLL_TARGET",
+		"poll-interval":                    "KFWPROXY_POLL_INTERVAL",
+		"version-regex":                    "KFWPROXY_VERSION_REGEX",
+		"history-size":                     "KFWPROXY_HISTORY_SIZE",
+		"history-max-age":                  "KFWPROXY_HISTORY_MAX_AGE",
+		"legacy-version-metrics":           "KFWPROXY_LEGACY_VERSION_METRICS",
+		"notify-concurrency":               "KFWPROXY_NOTIFY_CONCURRENCY",
+		"notify-retries":                   "KFWPROXY_NOTIFY_RETRIES",
+		"badge-max-age":                    "KFWPROXY_BADGE_MAX_AGE",
+		"svg-max-age":                      "KFWPROXY_SVG_MAX_AGE",
+		"badge-prefix":                     "KFWPROXY_BADGE_PREFIX",
+		"notify-debounce":                  "KFWPROXY_NOTIFY_DEBOUNCE",
+		"notify-replay":                    "KFWPROXY_NOTIFY_REPLAY",
+		"telegram-bot":                     "KFWPROXY_TELEGRAM_BOT",
+		"telegram-bot-file":                "KFWPROXY_TELEGRAM_BOT_FILE",
+		"telegram-chat":                    "KFWPROXY_TELEGRAM_CHAT",
+		"telegram-buttons":                 "KFWPROXY_TELEGRAM_BUTTONS",
+		"telegram-notes-updates":           "KFWPROXY_TELEGRAM_NOTES_UPDATES",
+		"telegram-parse-mode":              "KFWPROXY_TELEGRAM_PARSE_MODE",
+		"telegram-api-base":                "KFWPROXY_TELEGRAM_API_BASE",
+		"telegram-link-preview":            "KFWPROXY_TELEGRAM_LINK_PREVIEW",
+		"telegram-timeout":                 "KFWPROXY_TELEGRAM_TIMEOUT",
+		"telegram-chat-devices":            "KFWPROXY_TELEGRAM_CHAT_DEVICES",
+		"telegram-force":                   "KFWPROXY_TELEGRAM_FORCE",
+		"mobileread-user":                  "KFWPROXY_MOBILEREAD_USER",
+		"mobileread-user-file":             "KFWPROXY_MOBILEREAD_USER_FILE",
+		"mobileread-forum":                 "KFWPROXY_MOBILEREAD_FORUM",
+		"mobileread-timeout":               "KFWPROXY_MOBILEREAD_TIMEOUT",
+		"mobileread-subject-template":      "KFWPROXY_MOBILEREAD_SUBJECT_TEMPLATE",
+		"mobileread-tags":                  "KFWPROXY_MOBILEREAD_TAGS",
+		"mobileread-refresh":               "KFWPROXY_MOBILEREAD_REFRESH",
+		"mobileread-signature":             "KFWPROXY_MOBILEREAD_SIGNATURE",
+		"mobileread-forum-devices":         "KFWPROXY_MOBILEREAD_FORUM_DEVICES",
+		"mobileread-force":                 "KFWPROXY_MOBILEREAD_FORCE",
+		"log-json":                         "KFWPROXY_LOG_JSON",
+		"log-format":                       "KFWPROXY_LOG_FORMAT",
+		"access-log-sample":                "KFWPROXY_ACCESS_LOG_SAMPLE",
+		"log-level":                        "KFWPROXY_LOG_LEVEL",
+		"gzip-level":                       "KFWPROXY_GZIP_LEVEL",
+		"max-url-length":                   "KFWPROXY_MAX_URL_LENGTH",
+		"max-header-bytes":                 "KFWPROXY_MAX_HEADER_BYTES",
+		"cors-origin":                      "KFWPROXY_CORS_ORIGIN",
+		"trusted-proxies":                  "KFWPROXY_TRUSTED_PROXIES",
+		"root-page":                        "KFWPROXY_ROOT_PAGE",
+		"root-page-template":               "KFWPROXY_ROOT_PAGE_TEMPLATE",
+		"robots-txt":                       "KFWPROXY_ROBOTS_TXT",
+		"stats":                            "KFWPROXY_STATS",
+		"admin-token":                      "KFWPROXY_ADMIN_TOKEN",
+		"pprof":                            "KFWPROXY_PPROF",
+		"internal-auth":                    "KFWPROXY_INTERNAL_AUTH",
+		"mock-upgradecheck":                "KFWPROXY_MOCK_UPGRADECHECK",
+		"features":                         "KFWPROXY_FEATURES",
 	}
 
 	if val, ok := os.LookupEnv("PORT"); ok {
@@ -75,20 +231,295 @@ func main() {
 
 	pflag.Parse()
 
+	ft, err := ParseFeatures(Features{
+		"admin":     *adminToken != "",
+		"batch":     true,
+		"latest":    true,
+		"poller":    len(*pollTarget) != 0,
+		"pprof":     *pprofEnabled,
+		"root-page": *rootPage,
+		"stats":     *stats,
+	}, *featureList)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid features: %v.\n", err)
+		os.Exit(2)
+		return
+	}
+
+	if *logJSON && !pflag.CommandLine.Changed("log-format") {
+		if _, ok := os.LookupEnv(envmap["log-format"]); !ok { // env vars aren't marked as changed
+			*logFormat = "json"
+		}
+	}
+
 	var log zerolog.Logger
-	if *logJSON {
-		log = zerolog.New(os.Stdout)
-	} else {
+	switch *logFormat {
+	case "console":
 		log = zerolog.New(zerolog.ConsoleWriter{
 			Out:        os.Stdout,
 			NoColor:    false,
 			TimeFormat: time.ANSIC,
 			PartsOrder: []string{zerolog.TimestampFieldName, zerolog.LevelFieldName, "component", zerolog.MessageFieldName},
 		})
+	case "json":
+		log = zerolog.New(os.Stdout)
+	case "ecs":
+		// https://www.elastic.co/guide/en/ecs/current/ecs-base.html
+		zerolog.TimestampFieldName = "@timestamp"
+		zerolog.LevelFieldName = "log.level"
+		zerolog.MessageFieldName = "message"
+		zerolog.ErrorFieldName = "error.message"
+		zerolog.TimeFieldFormat = time.RFC3339Nano
+		log = zerolog.New(os.Stdout).With().Str("ecs.version", "1.6.0").Logger()
+	default:
+		fmt.Fprintf(os.Stderr, "Error: Invalid log-format %#v.\n", *logFormat)
+		os.Exit(2)
+		return
 	}
 	log = log.Level(zerolog.Level(*logLevel))
 	log = log.With().Timestamp().Logger()
 
+	if *cacheLimit <= 0 || *cacheCounters < 0 || *cacheBufferItems <= 0 || *cacheShards <= 0 || *staleIfErrorMax < 0 {
+		fmt.Fprintf(os.Stderr, "Error: cache-limit, cache-buffer-items, and cache-shards must be positive, and cache-counters and stale-if-error-max must not be negative.\n")
+		os.Exit(2)
+		return
+	}
+
+	counters := *cacheCounters
+	if counters == 0 {
+		counters = proxy.DefaultRistrettoCounters(*cacheLimit * 1000000)
+	}
+	if int64(*cacheShards) > *cacheLimit*1000000 || int64(*cacheShards) > counters {
+		fmt.Fprintf(os.Stderr, "Error: cache-shards must not be larger than cache-counters or the cache-limit in bytes.\n")
+		os.Exit(2)
+		return
+	}
+
+	extraRoutes := map[string]time.Duration{}
+	var extraRouteOrder []string
+	builtinRoutes := httprouter.New()
+	for _, u := range []string{"/api.kobobooks.com", upgradeCheckRoute, releaseNotesRoute} {
+		builtinRoutes.Handler("GET", u, http.NotFoundHandler())
+	}
+	for _, pr := range *proxyRoute {
+		x := strings.LastIndex(pr, "=")
+		if x == -1 || !strings.HasPrefix(pr, "/api.kobobooks.com/") {
+			fmt.Fprintf(os.Stderr, "Error: Invalid proxy-route %#v: must be in the format /api.kobobooks.com/path=ttl.\n", pr)
+			os.Exit(2)
+			return
+		}
+		var ttl time.Duration // zero for streaming
+		if v := pr[x+1:]; v != "stream" {
+			if ttl, err = time.ParseDuration(v); err != nil || ttl <= 0 {
+				fmt.Fprintf(os.Stderr, "Error: Invalid proxy-route %#v: invalid ttl.\n", pr)
+				os.Exit(2)
+				return
+			}
+		}
+		if _, ok := extraRoutes[pr[:x]]; ok {
+			fmt.Fprintf(os.Stderr, "Error: Invalid proxy-route %#v: duplicate route.\n", pr)
+			os.Exit(2)
+			return
+		}
+		if err := checkRoute(builtinRoutes, pr[:x]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid proxy-route %#v: %v.\n", pr, err)
+			os.Exit(2)
+			return
+		}
+		extraRoutes[pr[:x]] = ttl
+		extraRouteOrder = append(extraRouteOrder, pr[:x])
+	}
+
+	gzh, err := gziphandler.NewGzipLevelHandler(*gzipLevel)
+	if err != nil || *gzipLevel == gzip.NoCompression {
+		fmt.Fprintf(os.Stderr, "Error: Invalid gzip-level %d.\n", *gzipLevel)
+		os.Exit(2)
+		return
+	}
+
+	if *maxURLLength <= 0 || *maxHeaderBytes <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: max-url-length and max-header-bytes must be positive.\n")
+		os.Exit(2)
+		return
+	}
+
+	if *upstreamMaxIdleConns < 0 || *upstreamMaxIdleConnsPerHost <= 0 || *upstreamMaxConnsPerHost < 0 || *upstreamConcurrency < 0 {
+		fmt.Fprintf(os.Stderr, "Error: upstream-max-idle-conns-per-host must be positive, and upstream-max-idle-conns, upstream-max-conns-per-host, and upstream-concurrency must not be negative.\n")
+		os.Exit(2)
+		return
+	}
+
+	if (*internalAuth || ft["pprof"] || ft["admin"]) && *adminToken == "" {
+		fmt.Fprintf(os.Stderr, "Error: internal-auth, pprof, and admin require admin-token.\n")
+		os.Exit(2)
+		return
+	}
+
+	if ft["poller"] && len(*pollTarget) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: poller requires poll-target.\n")
+		os.Exit(2)
+		return
+	}
+
+	var mockUC []byte
+	if *mockUpgradeCheck != "" {
+		buf, err := ioutil.ReadFile(*mockUpgradeCheck)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Read mock-upgradecheck: %v.\n", err)
+			os.Exit(2)
+			return
+		}
+		if !json.Valid(buf) {
+			fmt.Fprintf(os.Stderr, "Error: mock-upgradecheck is not valid JSON.\n")
+			os.Exit(2)
+			return
+		}
+		mockUC = buf
+		fmt.Fprintf(os.Stderr, "Warning: Serving upgrade checks from %#v. This should only be used for testing.\n", *mockUpgradeCheck)
+	}
+
+	var delay func() time.Duration
+	if *simulateLatency != "" {
+		spl := strings.SplitN(*simulateLatency, "-", 2)
+		min, err1 := time.ParseDuration(spl[0])
+		max, err2 := min, error(nil)
+		if len(spl) == 2 {
+			max, err2 = time.ParseDuration(spl[1])
+		}
+		if err1 != nil || err2 != nil || min < 0 || max < min {
+			fmt.Fprintf(os.Stderr, "Error: Invalid simulate-latency %#v.\n", *simulateLatency)
+			os.Exit(2)
+			return
+		}
+		delay = func() time.Duration {
+			return min + time.Duration(rand.Int63n(int64(max-min)+1))
+		}
+		fmt.Fprintf(os.Stderr, "Warning: Simulating latency of %s for proxied responses. This should only be used for testing.\n", *simulateLatency)
+	}
+
+	cacheWeights := map[string]float64{}
+	for _, cw := range *cacheWeight {
+		x := strings.LastIndex(cw, "=")
+		if x == -1 {
+			fmt.Fprintf(os.Stderr, "Error: Invalid cache-weight %#v: must be in the format route=weight.\n", cw)
+			os.Exit(2)
+			return
+		}
+		wt, err := strconv.ParseFloat(cw[x+1:], 64)
+		if err != nil || wt <= 0 {
+			fmt.Fprintf(os.Stderr, "Error: Invalid cache-weight %#v: weight must be a positive number.\n", cw)
+			os.Exit(2)
+			return
+		}
+		if _, ok := extraRoutes[cw[:x]]; !ok && cw[:x] != "upgradecheck" && cw[:x] != "releasenotes" {
+			fmt.Fprintf(os.Stderr, "Error: Invalid cache-weight %#v: unknown route.\n", cw)
+			os.Exit(2)
+			return
+		}
+		cacheWeights[cw[:x]] = wt
+	}
+
+	var trusted []*net.IPNet
+	for _, c := range *trustedProxies {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid CIDR %#v in trusted-proxies: %v.\n", c, err)
+			os.Exit(2)
+			return
+		}
+		trusted = append(trusted, n)
+	}
+
+	rpt := defaultRootPage
+	if *rootPageTemplate != "" {
+		if !ft["root-page"] {
+			fmt.Fprintf(os.Stderr, "Error: root-page-template requires root-page.\n")
+			os.Exit(2)
+			return
+		}
+		buf, err := ioutil.ReadFile(*rootPageTemplate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Read root-page-template: %v.\n", err)
+			os.Exit(2)
+			return
+		}
+		rpt = string(buf)
+	}
+	rp, err := htmltemplate.New("root").Parse(rpt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid root-page-template: %v.\n", err)
+		os.Exit(2)
+		return
+	}
+
+	robots := []byte(defaultRobotsTxt)
+	if !ft["latest"] {
+		robots = bytes.Replace(robots, []byte("Allow: /latest/\n"), nil, 1)
+	}
+	if *robotsTxt != "" {
+		buf, err := ioutil.ReadFile(*robotsTxt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Read robots-txt: %v.\n", err)
+			os.Exit(2)
+			return
+		}
+		robots = buf
+	}
+
+	if *notifyConcurrency < 0 || *notifyRetries < 0 {
+		fmt.Fprintf(os.Stderr, "Error: notify-concurrency and notify-retries must not be negative.\n")
+		os.Exit(2)
+		return
+	}
+
+	if *historySize < 0 || *historyMaxAge < 0 {
+		fmt.Fprintf(os.Stderr, "Error: history-size and history-max-age must not be negative.\n")
+		os.Exit(2)
+		return
+	}
+
+	if err := latest.SetVersionPattern(*versionRegex); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid version-regex: %v.\n", err)
+		os.Exit(2)
+		return
+	}
+
+	for _, t := range *pollTarget {
+		if strings.Count(strings.Trim(t, "/"), "/") != 3 || *pollInterval <= 0 {
+			fmt.Fprintf(os.Stderr, "Error: poll-target must be in the format device/affiliate/version/serial, and poll-interval must be positive.\n")
+			os.Exit(2)
+			return
+		}
+	}
+
+	for _, sf := range []struct {
+		v, f *string
+		n    string
+	}{
+		{telegramBot, telegramBotFile, "telegram-bot"},
+		{mobilereadUser, mobilereadUserFile, "mobileread-user"},
+	} {
+		if *sf.f == "" {
+			continue
+		}
+		if *sf.v != "" {
+			fmt.Fprintf(os.Stderr, "Error: Only one of %s and %s-file can be specified.\n", sf.n, sf.n)
+			os.Exit(2)
+			return
+		}
+		buf, err := ioutil.ReadFile(*sf.f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Read %s-file: %v.\n", sf.n, err)
+			os.Exit(2)
+			return
+		}
+		if *sf.v = strings.TrimSpace(string(buf)); *sf.v == "" {
+			fmt.Fprintf(os.Stderr, "Error: %s-file %#v is empty.\n", sf.n, *sf.f)
+			os.Exit(2)
+			return
+		}
+	}
+
 	if (*telegramBot == "") != (len(*telegramChat) == 0) {
 		fmt.Fprintf(os.Stderr, "Error: Neither or both of telegram-bot and telegram-chat must be specified.\n")
 		os.Exit(2)
@@ -101,6 +532,18 @@ func main() {
 		return
 	}
 
+	if u, err := url.Parse(*telegramAPIBase); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fmt.Fprintf(os.Stderr, "Error: Invalid telegram-api-base %#v: must be a http or https URL.\n", *telegramAPIBase)
+		os.Exit(2)
+		return
+	}
+
+	if *telegramParseMode != "HTML" && *telegramParseMode != "MarkdownV2" {
+		fmt.Fprintf(os.Stderr, "Error: telegram-parse-mode must be HTML or MarkdownV2.\n")
+		os.Exit(2)
+		return
+	}
+
 	for _, fid := range *telegramForce {
 		var f bool
 		for _, id := range *telegramChat {
@@ -121,6 +564,52 @@ func main() {
 		return
 	}
 
+	tcd := map[string][]string{}
+	for _, cd := range *telegramChatDevices {
+		spl := strings.SplitN(cd, "=", 2)
+		if len(spl) != 2 || !containsString(*telegramChat, spl[0]) || !validPattern(spl[1]) {
+			fmt.Fprintf(os.Stderr, "Error: Invalid telegram-chat-devices %#v: must be chat=pattern, with the chat in telegram-chat and a valid pattern.\n", cd)
+			os.Exit(2)
+			return
+		}
+		tcd[spl[0]] = append(tcd[spl[0]], spl[1])
+	}
+
+	mfd := map[int][]string{}
+	for _, fd := range *mobilereadForumDevices {
+		spl := strings.SplitN(fd, "=", 2)
+		var fi int
+		var err error
+		if len(spl) == 2 {
+			fi, err = strconv.Atoi(spl[0])
+		}
+		if len(spl) != 2 || err != nil || !containsInt(*mobilereadForum, fi) || !validPattern(spl[1]) {
+			fmt.Fprintf(os.Stderr, "Error: Invalid mobileread-forum-devices %#v: must be forum=pattern, with the forum in mobileread-forum and a valid pattern.\n", fd)
+			os.Exit(2)
+			return
+		}
+		mfd[fi] = append(mfd[fi], spl[1])
+	}
+
+	mst, err := template.New("subject").Parse(*mobilereadSubject)
+	if err == nil {
+		var b strings.Builder
+		if err = mst.Execute(&b, struct{ Version latest.Version }{latest.Version{4, 0, 0}}); err == nil && strings.TrimSpace(b.String()) == "" {
+			err = fmt.Errorf("empty subject")
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid mobileread-subject-template: %v.\n", err)
+		os.Exit(2)
+		return
+	}
+
+	if len(*mobilereadSignature) > 1000 {
+		fmt.Fprintf(os.Stderr, "Error: Invalid mobileread-signature: must be at most 1000 bytes.\n")
+		os.Exit(2)
+		return
+	}
+
 	for _, fid := range *mobilereadForce {
 		var f bool
 		for _, id := range *mobilereadForum {
@@ -145,222 +634,561 @@ func main() {
 		return
 	}
 
-	var p []interface{ WritePrometheus(io.Writer) }
-	j, _ := cookiejar.New(nil)
-	cl := &http.Client{Timeout: *timeout, Jar: j}
+	var p []promComponent
+	rm := new(RuntimeMetrics)
+	kt := rm.Transport()
+	kt.MaxIdleConns = *upstreamMaxIdleConns
+	kt.MaxIdleConnsPerHost = *upstreamMaxIdleConnsPerHost
+	kt.MaxConnsPerHost = *upstreamMaxConnsPerHost
+	if !*upstreamHTTP2 {
+		kt.ForceAttemptHTTP2 = false
+		kt.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{} // non-nil disables HTTP/2
+	}
+	kc := &http.Client{Timeout: *timeout, Transport: kt}
+	tc := &http.Client{Timeout: *telegramTimeout}
+	mj, _ := cookiejar.New(nil)
+	mc := &http.Client{Timeout: *mobilereadTimeout, Jar: mj} // the jar is only used for MobileRead, so the session cookies are never sent elsewhere
 	uc := uptimeCounter(time.Now())
-	c := NewRistrettoCache(*cacheLimit * 1000000)
-	l := NewLatestTracker(log.With().Str("component", "latest").Logger())
-	p = append(p, uc, c, l)
+	c := proxy.NewShardedRistrettoCache(*cacheLimit*1000000, *cacheCounters, *cacheBufferItems, *cacheShards)
+	c.Retain = *cacheRetain
+	if c.Retain < *staleIfErrorMax {
+		c.Retain = *staleIfErrorMax
+	}
+	l := latest.NewLatestTracker(*notifyDebounce, log.With().Str("component", "latest").Logger())
+	l.Client = kc
+	l.HistorySize = *historySize
+	l.HistoryMaxAge = *historyMaxAge
+	l.LegacyVersionMetrics = *legacyVersionMetrics
+	l.GzipLevel = *gzipLevel
+	l.BadgePrefix = *badgePrefix
+	l.BadgeMaxAge = *badgeMaxAge
+	l.SVGMaxAge = *svgMaxAge
+	l.NotifyConcurrency = *notifyConcurrency
+	l.ReplayNotify = *notifyReplay
+	l.NotifyRetries = *notifyRetries
+	hm := metrics.NewSet()
+	mt := new(proxy.Switch)
+	mt.Set(*maintenance)
+	hm.NewGauge("kfwproxy_maintenance_enabled", func() float64 {
+		if mt.On() {
+			return 1
+		}
+		return 0
+	})
+	us := NewHyperLogLog()
+	hm.NewGauge("kfwproxy_unique_serials_estimate", func() float64 { return float64(us.Estimate()) })
+	p = append(p, promComponent{"uptime", uc}, promComponent{"cache", c}, promComponent{"latest", l}, promComponent{"http", hm}, promComponent{"runtime", rm})
 
-	if *telegramBot != "" {
+	var b *proxy.Breaker
+	if *breakerThreshold > 0 {
+		b = &proxy.Breaker{Name: "kobo", Threshold: *breakerThreshold, Cooldown: *breakerCooldown}
+		p = append(p, promComponent{"breaker", b})
+	}
+
+	var ul *proxy.Limiter
+	if *upstreamConcurrency > 0 {
+		ul = &proxy.Limiter{Name: "kobo", Max: *upstreamConcurrency}
+		p = append(p, promComponent{"limiter", ul})
+	}
+
+	var ns sync.Map // map[string]string, the notifier initialization status
+	var ne sync.Map // map[string][]string, the notifier initialization errors
+
+	// initialized records the result of initializing a notifier.
+	initialized := func(name, component string, errs []error) {
+		es := make([]string, len(errs))
+		for i, err := range errs {
+			es[i] = err.Error()
+			log.Warn().Err(err).Str("component", "kfwproxy").Str("notifier", component).Msgf("%s initialization error", name)
+		}
+		ne.Store(component, es)
+		if len(errs) == 0 {
+			ns.Store(component, "ok")
+			log.Info().Str("component", "kfwproxy").Msgf("initialized %s", name)
+		} else {
+			ns.Store(component, "degraded")
+			log.Warn().Str("component", "kfwproxy").Int("errors", len(errs)).Msgf("initialized %s with %d errors", name, len(errs))
+		}
+	}
+
+	if *telegramBot != "" && ft["latest"] {
+		ns.Store("telegram", "initializing")
 		go func() {
 			log.Info().Str("component", "kfwproxy").Msg("initializing Telegram")
-			tc, err := NewTelegram(cl, *telegramBot)
+			tg, err := NewTelegram(tc, *telegramAPIBase, *telegramBot)
 			if err != nil {
 				log.Err(err).Str("component", "kfwproxy").Msg("could not initialize Telegram bot")
+				ns.Store("telegram", "error")
+				ne.Store("telegram", []string{err.Error()})
 				return
 			}
-			tn, _ := NewTelegramNotifier(tc, *telegramChat, *telegramForce, log.With().Str("component", "telegram").Logger())
+			tn, errs := NewTelegramNotifier(tg, *telegramChat, *telegramForce, log.With().Str("component", "telegram").Logger())
+			tn.ParseMode = *telegramParseMode
+			tn.LinkPreview = *telegramLinkPreview
+			tn.NotesUpdates = *telegramNotesUpdates
+			tn.Devices = tcd
+			if *telegramButtons {
+				tn.Buttons = func(v latest.Version) []TelegramButton {
+					var b []TelegramButton
+					if h, ok := l.HistoryVersion(v); ok { // not the current URLs, since the notification may be delayed
+						if h.NotesURL != "" {
+							b = append(b, TelegramButton{Text: "Release Notes", URL: h.NotesURL})
+						}
+						if h.UpgradeURL != "" {
+							b = append(b, TelegramButton{Text: "Download", URL: h.UpgradeURL})
+						}
+					}
+					b = append(b, TelegramButton{Text: "More Info", URL: "https://pgaskin.net/KoboStuff/kobofirmware.html"})
+					return b
+				}
+			}
 			l.Notify(tn)
-			p = append(p, tn)
-			log.Info().Str("component", "kfwproxy").Msg("initialized Telegram")
+			p = append(p, promComponent{"telegram", tn})
+			initialized("Telegram", "telegram", errs)
 		}()
 	}
 
-	if *mobilereadUser != "" {
+	if *mobilereadUser != "" && ft["latest"] {
+		ns.Store("mobileread", "initializing")
 		go func() {
 			log.Info().Str("component", "kfwproxy").Msg("initializing MobileRead")
 			spl := strings.SplitN(*mobilereadUser, ":", 2)
-			mr, err := NewMobileRead(cl, spl[0], spl[1])
+			mr, err := NewMobileRead(mc, spl[0], spl[1])
 			if err != nil {
 				log.Err(err).Str("component", "kfwproxy").Msg("could not initialize MobileRead user")
+				ns.Store("mobileread", "error")
+				ne.Store("mobileread", []string{err.Error()})
 				return
 			}
-			mn, _ := NewMobileReadNotifier(mr, *mobilereadForum, *mobilereadForce, log.With().Str("component", "mobileread").Logger())
+			mn, errs := NewMobileReadNotifier(mr, *mobilereadForum, *mobilereadForce, mst, *mobilereadTags, log.With().Str("component", "mobileread").Logger())
+			mn.Devices = mfd
+			mn.Signature = *mobilereadSignature
 			l.Notify(mn)
-			p = append(p, mn)
-			log.Info().Str("component", "kfwproxy").Msg("initialized MobileRead")
+			if *mobilereadRefresh > 0 {
+				go mn.KeepAlive(*mobilereadRefresh)
+			}
+			p = append(p, promComponent{"mobileread", mn})
+			initialized("MobileRead", "mobileread", errs)
 		}()
 	}
 
-	r := httprouter.New()
+	r := &routeRecorder{Router: httprouter.New()}
+	r.HandleMethodNotAllowed = true
+	r.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// note: httprouter sets Allow to the methods registered for the path
+		// (OPTIONS is always allowed since GlobalOPTIONS is set)
+		w.Header().Set("Server", "kfwproxy")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	})
+	r.GlobalOPTIONS = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// note: httprouter only calls this for paths matching a route, and sets
+		// Allow to the methods registered for it
+		w.Header().Set("Content-Length", "0")
+		w.Header().Set("Server", "kfwproxy")
+		if !strings.HasPrefix(r.URL.Path, "/admin/") {
+			proxy.SetCORSOrigin(w, r, *corsOrigin)
+			w.Header().Set("Access-Control-Allow-Methods", w.Header().Get("Allow"))
+			w.Header().Set("Access-Control-Expose-Headers", "X-KFWProxy-Request-ID")
+		}
+		w.WriteHeader(http.StatusOK)
+	})
 
-	r.Handler("GET", "/", http.RedirectHandler("https://github.com/pgaskin/kfwproxy", http.StatusTemporaryRedirect))
+	if ft["root-page"] {
+		r.HandlerFunc("GET", "/", func(w http.ResponseWriter, r *http.Request) {
+			var v string
+			if lv := l.Version(); !lv.Zero() {
+				v = lv.String()
+			}
+			var buf bytes.Buffer
+			if err := rp.Execute(&buf, map[string]interface{}{
+				"Version":    v,
+				"UpgradeURL": l.UpgradeURL(),
+				"NotesURL":   l.NotesURL(),
+				"Latest":     ft["latest"],
+			}); err != nil {
+				if hl := hlog.FromRequest(r); hl != nil {
+					hl.Err(err).Str("component", "kfwproxy").Msg("could not execute root page template")
+				}
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write(buf.Bytes())
+		})
+	} else {
+		r.Handler("GET", "/", http.RedirectHandler("https://github.com/pgaskin/kfwproxy", http.StatusTemporaryRedirect))
+	}
 
-	for _, v := range []struct {
+	type route struct {
+		n string
 		u string
-		h *ProxyHandler
-	}{
-		{"/api.kobobooks.com/1.0/UpgradeCheck/Device/:device/:affiliate/:version/:serial", &ProxyHandler{
+		h *proxy.ProxyHandler
+	}
+
+	routes := []route{
+		{"upgradecheck", upgradeCheckRoute, &proxy.ProxyHandler{
 			PassHeaders: []string{"X-Kobo-Accept-Preview"},
-			Hook: func(r *http.Request, buf []byte) {
+			VaryHeaders: []string{"X-Kobo-Accept-Preview"},
+			Hook: func(r *http.Request, contentType string, buf []byte) {
+				if sn := httprouter.ParamsFromContext(r.Context()).ByName("serial"); sn != "" {
+					us.Add(sn)
+				}
+				if mt, _, _ := mime.ParseMediaType(contentType); mt != "application/json" {
+					return // e.g. a CDN error page
+				}
 				if strings.HasPrefix(httprouter.ParamsFromContext(r.Context()).ByName("device"), "00000000-0000-0000-0000-0000000006") {
 					return // ignore tolino requests until we handle branched versions properly
 				}
-				go l.InterceptUpgradeCheck(buf)
+				ps := httprouter.ParamsFromContext(r.Context())
+				go l.InterceptAffiliateUpgradeCheck(ps.ByName("device"), ps.ByName("affiliate"), buf)
 			},
 			CacheTTL: *cacheTime,
-			CacheID:  func(r *http.Request) string { return r.URL.String() + r.Header.Get("X-Kobo-Accept-Preview") },
+			CacheID: func(r *http.Request) string {
+				if pv := strings.TrimSpace(r.Header.Get("X-Kobo-Accept-Preview")); pv != "" {
+					return r.URL.String() + "#preview=" + pv
+				}
+				return r.URL.String()
+			},
 		}},
-		{"/api.kobobooks.com/1.0/ReleaseNotes/:idx", &ProxyHandler{
-			CacheTTL: time.Hour * 3,
-			CacheID:  func(r *http.Request) string { return r.URL.String() },
+		{"releasenotes", releaseNotesRoute, &proxy.ProxyHandler{
+			CacheTTL:                    time.Hour * 3,
+			CacheID:                     func(r *http.Request) string { return r.URL.String() },
+			RespectUpstreamCacheControl: true,
 		}},
-	} {
-		v.h.Client = cl
+	}
+	for _, u := range extraRouteOrder {
+		routes = append(routes, route{u, u, &proxy.ProxyHandler{
+			Stream:   extraRoutes[u] == 0,
+			CacheTTL: extraRoutes[u],
+			CacheID:  func(r *http.Request) string { return r.URL.String() },
+		}})
+	}
+
+	for _, v := range routes {
+		v.h.Client = kc
 		v.h.UserAgent = "kfwproxy (github.com/pgaskin/kfwproxy)"
 		v.h.Server = "kfwproxy"
 		v.h.CORS = true
+		v.h.CORSOrigins = *corsOrigin
 		v.h.Cache = c
+		v.h.CacheOnly = mt
+		v.h.StaleIfError = *staleIfErrorMax
+		v.h.Delay = delay
+		v.h.CacheWeight = cacheWeights[v.n]
+		if v.n == "upgradecheck" && mockUC != nil {
+			v.h.Client = &http.Client{Transport: mockTransport(mockUC)}
+		}
+		v.h.Breaker = b
+		v.h.Limiter = ul
+		v.h.Name = v.n
+		v.h.Metrics = hm
 		for _, m := range []string{"GET", "HEAD", "OPTIONS"} {
 			r.Handler(m, v.u, v.h)
 		}
 	}
 
-	r.HandlerFunc("GET", "/stats", c.StatsHandler(time.Time(uc)))
-	r.HandlerFunc("GET", "/metrics", func(w http.ResponseWriter, r *http.Request) {
+	r.HandlerFunc("GET", "/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "max-age=86400")
+		w.Write(robots)
+	})
+
+	internal := func(h http.HandlerFunc) http.HandlerFunc {
+		if *internalAuth {
+			return adminAuth(*adminToken, h)
+		}
+		return h
+	}
+
+	if ft["stats"] {
+		r.HandlerFunc("GET", "/stats", internal(c.StatsHandler(time.Time(uc))))
+	}
+	r.HandlerFunc("GET", "/metrics", internal(func(w http.ResponseWriter, r *http.Request) {
 		for _, m := range p {
 			m.WritePrometheus(w)
 		}
-	})
+	}))
+	r.HandlerFunc("GET", "/metrics/:component", internal(func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range p {
+			if m.Name == httprouter.ParamsFromContext(r.Context()).ByName("component") {
+				m.WritePrometheus(w)
+				return
+			}
+		}
+		http.Error(w, "No such component", http.StatusNotFound)
+	}))
 
-	l.Mount(r)
+	var sm sync.Mutex
+	var sb []byte
+	var st time.Time
+	r.HandlerFunc("GET", "/status.json", func(w http.ResponseWriter, r *http.Request) {
+		sm.Lock()
+		defer sm.Unlock()
 
-	hdl := hlog.NewHandler(log)(hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
-		hlog.FromRequest(r).Debug().
-			Str("component", "http").
-			Str("method", r.Method).
-			Str("url", r.URL.String()).
-			Int("status", status).
-			Int("size", size).
-			Dur("duration", duration).
-			Msg("handled")
-	})(hlog.RequestIDHandler("request_id", "X-KFWProxy-Request-ID")(r)))
+		// note: this is cached since it's meant to be polled by monitors
+		if time.Since(st) > time.Second*5 {
+			var lv string
+			if v := l.Version(); !v.Zero() {
+				lv = v.String()
+			}
+			obj := map[string]interface{}{
+				"latest_version":  lv,
+				"latest_notes":    l.NotesURL(),
+				"cache_hit_ratio": c.HitRatio(),
+				"uptime_seconds":  int(time.Since(time.Time(uc)).Seconds()),
+				"maintenance":     mt.On(),
+			}
+			ns.Range(func(k, v interface{}) bool {
+				obj["notifier_"+k.(string)] = v
+				return true
+			})
+			ne.Range(func(k, v interface{}) bool {
+				obj["notifier_"+k.(string)+"_errors"] = v
+				return true
+			})
+			sb, _ = json.Marshal(obj)
+			st = time.Now()
+		}
 
-	r.HandlerFunc("OPTIONS", "/api.kobobooks.com", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Length", "0")
-		w.Header().Set("Server", "kfwproxy")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
-		w.Header().Set("Access-Control-Expose-Headers", "X-KFWProxy-Request-ID")
-		w.WriteHeader(http.StatusOK)
-		return
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "max-age=5")
+		w.Write(sb)
 	})
 
-	r.Handler("GET", "/api.kobobooks.com", func(hdl http.Handler) http.Handler {
-		type batchKey string
-		const batched = batchKey("batched")
-		return gziphandler.GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			var log zerolog.Logger
-			if hl := hlog.FromRequest(r); hl != nil {
-				log = hl.With().Str("component", "batch").Logger()
-			} else {
-				log = zerolog.Nop()
-			}
+	if ft["latest"] {
+		l.Mount(r)
+	}
 
-			w.Header().Set("Server", "kfwproxy")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
-			w.Header().Set("Access-Control-Expose-Headers", "X-KFWProxy-Request-ID")
+	if *adminToken != "" {
+		if ft["pprof"] {
+			r.HandlerFunc("GET", "/debug/pprof/*name", adminAuth(*adminToken, func(w http.ResponseWriter, r *http.Request) {
+				name := httprouter.ParamsFromContext(r.Context()).ByName("name")
 
-			if r.Context().Value(batched) != nil {
-				log.Warn().Msg("recursive batch")
-				http.Error(w, "Batch recursion not allowed", http.StatusForbidden)
-				return
+				// note: profiles must finish before the write timeout
+				if *writeTimeout > 0 {
+					ms := int((*writeTimeout - time.Second*5).Seconds())
+					if ms < 1 {
+						ms = 1
+					}
+					q := r.URL.Query()
+					sec, err := strconv.Atoi(q.Get("seconds"))
+					if err != nil && name == "/profile" {
+						sec = 30 // the default
+					}
+					if sec > ms {
+						q.Set("seconds", strconv.Itoa(ms))
+						r.URL.RawQuery = q.Encode()
+					}
+				}
+
+				switch name {
+				case "/cmdline":
+					http.NotFound(w, r) // note: the arguments may contain secrets
+				case "/profile":
+					pprof.Profile(w, r)
+				case "/symbol":
+					pprof.Symbol(w, r)
+				case "/trace":
+					pprof.Trace(w, r)
+				default:
+					pprof.Index(w, r) // note: this also serves the named profiles
+				}
+			}))
+		}
+	}
+
+	if *adminToken != "" && ft["admin"] {
+		r.HandlerFunc("GET", "/admin/config", adminAuth(*adminToken, func(w http.ResponseWriter, _ *http.Request) {
+			// note: this must never include tokens or credentials
+			ver := "unknown"
+			if bi, ok := debug.ReadBuildInfo(); ok {
+				ver = bi.Main.Version
+			}
+			status := func(name string) interface{} {
+				v, _ := ns.Load(name)
+				return v
+			}
+			routes := make(map[string]string, len(extraRoutes))
+			for u, ttl := range extraRoutes {
+				if ttl == 0 {
+					routes[u] = "stream"
+				} else {
+					routes[u] = ttl.String()
+				}
 			}
+			buf, _ := json.MarshalIndent(map[string]interface{}{
+				"version":            ver,
+				"go_version":         runtime.Version(),
+				"cache_limit_mb":     *cacheLimit,
+				"cache_shards":       *cacheShards,
+				"cache_time":         cacheTime.String(),
+				"cache_retain":       c.Retain.String(),
+				"stale_if_error_max": staleIfErrorMax.String(),
+				"timeout":            timeout.String(),
+				"batch_timeout":      batchTimeout.String(),
+				"batch_limit":        batchLimit,
+				"maintenance":        mt.On(),
+				"features":           ft.Enabled(),
+				"proxy_routes":       routes,
+				"notifiers": map[string]interface{}{
+					"telegram": map[string]interface{}{
+						"enabled": *telegramBot != "" && ft["latest"],
+						"status":  status("telegram"),
+						"chats":   len(*telegramChat),
+					},
+					"mobileread": map[string]interface{}{
+						"enabled": *mobilereadUser != "" && ft["latest"],
+						"status":  status("mobileread"),
+						"forums":  len(*mobilereadForum),
+					},
+				},
+			}, "", "  ")
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write(buf)
+		}))
+		r.HandlerFunc("GET", "/admin/routes", adminAuth(*adminToken, func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			for _, rt := range r.Routes() {
+				fmt.Fprintln(w, rt)
+			}
+		}))
+	}
 
-			xs := r.URL.Query()["x"]
-			if len(xs) == 0 {
-				http.Error(w, "Parameter x[] missing for batch GET", http.StatusBadRequest)
+	if *adminToken != "" && ft["admin"] {
+		r.HandlerFunc("POST", "/admin/notify", adminAuth(*adminToken, func(w http.ResponseWriter, r *http.Request) {
+			v, err := latest.ExtractVersion(r.URL.Query().Get("version"))
+			if err != nil || v.Zero() {
+				http.Error(w, "Parameter version missing or invalid", http.StatusBadRequest)
 				return
 			}
-			if len(xs) > 20 {
-				log.Warn().Msg("too many requests in batch GET")
-				http.Error(w, "Too many requests in batch GET", http.StatusForbidden)
+			if hl := hlog.FromRequest(r); hl != nil {
+				hl.Warn().
+					Str("component", "admin").
+					Str("version", v.String()).
+					Msg("manually triggering notifications")
+			}
+			l.NotifyManual(v)
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, "Sending notifications for %s\n", v)
+		}))
+		r.HandlerFunc("POST", "/admin/release", adminAuth(*adminToken, func(w http.ResponseWriter, r *http.Request) {
+			var obj struct {
+				Version    string `json:"version"`
+				NotesURL   string `json:"notes_url"`
+				UpgradeURL string `json:"upgrade_url"`
+			}
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&obj); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
 				return
 			}
-
-			hd := r.URL.Query().Get("h")
-			if hd != "" && hd != "1" {
-				http.Error(w, "Parameter h must be 1 or unset for batch GET", http.StatusBadRequest)
+			v, err := latest.ExtractVersion(obj.Version)
+			if err != nil || v.Zero() {
+				http.Error(w, "Field version missing or invalid", http.StatusBadRequest)
 				return
 			}
+			if hl := hlog.FromRequest(r); hl != nil {
+				hl.Warn().
+					Str("component", "admin").
+					Str("version", v.String()).
+					Msg("externally triggered release")
+			}
+			l.InterceptRelease(v, obj.UpgradeURL, obj.NotesURL)
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, "Received release %s\n", v)
+		}))
+		r.HandlerFunc("POST", "/admin/maintenance", adminAuth(*adminToken, func(w http.ResponseWriter, r *http.Request) {
+			on, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+			if err != nil {
+				http.Error(w, "Parameter enabled must be true or false", http.StatusBadRequest)
+				return
+			}
+			if hl := hlog.FromRequest(r); hl != nil {
+				hl.Warn().
+					Str("component", "admin").
+					Bool("enabled", on).
+					Msg("setting maintenance mode")
+			}
+			mt.Set(on)
+			fmt.Fprintf(w, "Maintenance mode: %t\n", on)
+		}))
+	}
 
-			log.Info().Int("n", len(xs)).Msg("processing batch request")
-
-			res := make([]struct {
-				Status int                 `json:"status"`
-				Header map[string][]string `json:"header,omitempty"`
-				Body   string              `json:"body"`
-			}, len(xs))
-
-			cache, noCache := int((*cacheTime).Seconds()), false
-
-			for i, x := range xs {
-				x = "/api.kobobooks.com/" + strings.TrimPrefix(x, "/")
+	var accessN uint64
+	hdl := hlog.NewHandler(log)(hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
+		hm.GetOrCreateCounter(`kfwproxy_http_responses_total{code="` + strconv.Itoa(status) + `"}`).Inc()
 
-				rc := httptest.NewRecorder()
-				rq, err := http.NewRequestWithContext(context.WithValue(r.Context(), batched, true), "GET", x, nil)
-				if err != nil {
-					res[i].Status = http.StatusBadRequest
-					res[i].Body = err.Error()
-					continue
-				}
+		lvl := zerolog.DebugLevel
+		if status >= 400 || (*accessLogSample != 0 && atomic.AddUint64(&accessN, 1)%*accessLogSample == 0) {
+			lvl = zerolog.InfoLevel
+		}
+		hlog.FromRequest(r).WithLevel(lvl).
+			Str("component", "http").
+			Str("client", ClientKey(r, trusted)).
+			Str("method", r.Method).
+			Str("url", r.URL.String()).
+			Int("status", status).
+			Int("size", size).
+			Dur("duration", duration).
+			Msg("handled")
+	})(hlog.RequestIDHandler("request_id", "X-KFWProxy-Request-ID")(limitRequest(*maxURLLength, *maxHeaderBytes, r))))
 
-				hdl.ServeHTTP(rc, rq)
-
-				// cache for the minimum max-age if all requests are successful
-				if !noCache {
-					if rc.Code != http.StatusOK {
-						noCache = true
-					} else if cc := rc.HeaderMap.Get("Cache-Control"); cc != "" { // kfwproxy endpoints return Cache-Control or nothing, so we don't need to handle Expires or the other ones
-						for _, ccs := range strings.Split(cc, ",") {
-							if strings.HasPrefix(strings.TrimSpace(ccs), "max-age=") {
-								if c, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(ccs, "=", 2)[1])); err != nil {
-									continue
-								} else {
-									if c <= 0 {
-										noCache = true
-									} else if c < cache {
-										cache = c
-									}
-								}
-							}
-						}
-					}
-				}
+	if ft["batch"] {
+		r.HandlerFunc("OPTIONS", "/api.kobobooks.com", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "0")
+			w.Header().Set("Server", "kfwproxy")
+			proxy.SetCORSOrigin(w, r, *corsOrigin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			w.Header().Set("Access-Control-Expose-Headers", "X-KFWProxy-Request-ID")
+			w.WriteHeader(http.StatusOK)
+			return
+		})
 
-				res[i].Status = rc.Code
-				if hd == "1" {
-					res[i].Header = rc.HeaderMap
-				}
-				res[i].Body = rc.Body.String() // note: if binary responses are added anywhere in the future, it will need to be checked and return an error instead
-			}
+		r.Handler("GET", "/api.kobobooks.com", gzh(batchHandler(hdl, hm, *corsOrigin, int((*cacheTime).Seconds()), *batchTimeout)))
+	}
 
-			if noCache {
-				w.Header().Set("Cache-Control", "no-cache")
-				w.Header().Set("Pragma", "no-cache")
-				w.Header().Set("Expires", "0")
-			} else {
-				w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(cache))
-				w.Header().Set("Expires", time.Now().Add(time.Duration(cache)*time.Second).Format(http.TimeFormat))
-			}
+	for _, rt := range r.Routes() {
+		log.Debug().Str("component", "kfwproxy").Msgf("registered route %s", rt)
+	}
 
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
+	if len(*pollTarget) != 0 && ft["poller"] {
+		pl := NewPoller(r, *pollTarget, *pollInterval, log.With().Str("component", "poller").Logger())
+		p = append(p, promComponent{"poller", pl})
+		pl.Run()
+	}
 
-			enc := json.NewEncoder(w)
-			enc.SetEscapeHTML(false)
-			enc.Encode(res)
-		}))
-	}(hdl))
+	var ln net.Listener
+	if sock := strings.TrimPrefix(*addr, "unix:"); sock != *addr {
+		// remove the socket left behind by a previous instance, if any
+		if fi, err := os.Lstat(sock); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(sock)
+		}
+		ln, err = net.Listen("unix", sock)
+	} else {
+		ln, err = net.Listen("tcp", *addr)
+	}
+	if err != nil {
+		log.Fatal().
+			Str("component", "kfwproxy").
+			AnErr("err", err).
+			Msg("could not listen")
+		os.Exit(1)
+	}
 
 	log.Info().
 		Str("component", "kfwproxy").
 		Str("addr", *addr).
-		Msgf("Listening on http://%s", *addr)
-	if err := http.ListenAndServe(*addr, hdl); err != nil {
+		Strs("features", ft.Enabled()).
+		Msgf("Listening on %s", *addr)
+	srv := &http.Server{
+		Handler:        hdl,
+		MaxHeaderBytes: *maxHeaderBytes, // hard limit, the exact one is checked by limitRequest
+		ReadTimeout:    *readTimeout,
+		WriteTimeout:   *writeTimeout,
+		IdleTimeout:    *idleTimeout,
+	}
+	if err := srv.Serve(ln); err != nil {
 		log.Fatal().
 			Str("component", "kfwproxy").
 			AnErr("err", err).
@@ -369,6 +1197,191 @@ func main() {
 	}
 }
 
+const defaultRootPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>kfwproxy</title>
+<style>body{font-family:sans-serif;max-width:40em;margin:2em auto;padding:0 1em;line-height:1.5}code{background:#eee;padding:0 .25em}</style>
+</head>
+<body>
+<h1>kfwproxy</h1>
+<p>A caching proxy for the Kobo firmware upgrade API, which also tracks the latest firmware version.</p>
+{{if .Version}}
+<p>The latest firmware version is <strong>{{.Version}}</strong>.{{if .UpgradeURL}} <a href="{{.UpgradeURL}}">Download</a>{{end}}{{if .NotesURL}} &middot; <a href="{{.NotesURL}}">Release notes</a>{{end}}</p>
+{{else}}
+<p>The latest firmware version isn't known yet.</p>
+{{end}}
+<h2>Endpoints</h2>
+<ul>
+{{if .Latest}}
+<li><a href="/latest/version"><code>/latest/version</code></a> (<a href="/latest/version/svg">svg</a>, <a href="/latest/version/png">png</a>, <a href="/latest/version/shield.json">shields.io</a>, <a href="/latest/version/redir">download</a>)</li>
+<li><a href="/latest/notes"><code>/latest/notes</code></a> (<a href="/latest/notes/redir">redirect</a>)</li>
+<li><a href="/latest/changelog.txt"><code>/latest/changelog.txt</code></a></li>
+<li><a href="/latest/history.csv"><code>/latest/history.csv</code></a></li>
+{{end}}
+<li><a href="/status.json"><code>/status.json</code></a></li>
+</ul>
+<p><a href="https://github.com/pgaskin/kfwproxy">Source code</a></p>
+</body>
+</html>
+`
+
+const defaultRobotsTxt = `User-agent: *
+Allow: /latest/
+Disallow: /api.kobobooks.com
+Disallow: /admin/
+Disallow: /stats
+Disallow: /metrics
+Disallow: /debug/
+`
+
+func containsString(a []string, v string) bool {
+	for _, x := range a {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(a []int, v int) bool {
+	for _, x := range a {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func validPattern(p string) bool {
+	_, err := path.Match(p, "")
+	return err == nil
+}
+
+type promWriter interface {
+	WritePrometheus(io.Writer)
+}
+
+// promComponent is a named set of metrics.
+type promComponent struct {
+	Name string
+	promWriter
+}
+
+// adminAuth wraps h to require the specified token, either as a bearer token or
+// as the basic auth password (with any username).
+func adminAuth(token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var t string
+		var ok bool
+		if a := r.Header.Get("Authorization"); strings.HasPrefix(a, "Bearer ") {
+			t, ok = strings.TrimPrefix(a, "Bearer "), true
+		} else if _, pw, isBasic := r.BasicAuth(); isBasic {
+			t, ok = pw, true
+		}
+		if !ok || subtle.ConstantTimeCompare([]byte(t), []byte(token)) != 1 {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="kfwproxy"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="kfwproxy"`)
+			http.Error(w, "Missing or invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// limitRequest wraps h to reject requests with URLs longer than maxURL or
+// headers larger than maxHeader.
+func limitRequest(maxURL, maxHeader int, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.RequestURI) > maxURL || len(r.URL.String()) > maxURL {
+			http.Error(w, http.StatusText(http.StatusRequestURITooLong), http.StatusRequestURITooLong)
+			return
+		}
+		n := len(r.Host)
+		for k, vs := range r.Header {
+			for _, v := range vs {
+				n += len(k) + len(v) + 4 // ": " and "\r\n"
+			}
+		}
+		if n > maxHeader {
+			http.Error(w, http.StatusText(http.StatusRequestHeaderFieldsTooLarge), http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// checkRoute adds a route to r, returning an error instead of panicking if it
+// is invalid or conflicts with an existing one.
+func checkRoute(r *httprouter.Router, path string) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("%v", v)
+		}
+	}()
+	r.Handler("GET", path, http.NotFoundHandler())
+	return nil
+}
+
+// routeRecorder wraps a httprouter.Router to record the registered routes.
+type routeRecorder struct {
+	*httprouter.Router
+	m sync.Mutex
+	r []string
+}
+
+func (rr *routeRecorder) Handle(method, path string, handle httprouter.Handle) {
+	rr.record(method, path)
+	rr.Router.Handle(method, path, handle)
+}
+
+func (rr *routeRecorder) Handler(method, path string, handler http.Handler) {
+	rr.record(method, path)
+	rr.Router.Handler(method, path, handler)
+}
+
+func (rr *routeRecorder) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	rr.record(method, path)
+	rr.Router.HandlerFunc(method, path, handler)
+}
+
+func (rr *routeRecorder) record(method, path string) {
+	rr.m.Lock()
+	rr.r = append(rr.r, method+" "+path)
+	rr.m.Unlock()
+}
+
+// Routes returns the registered routes in the format "METHOD /path", sorted by
+// path.
+func (rr *routeRecorder) Routes() []string {
+	rr.m.Lock()
+	r := append([]string(nil), rr.r...)
+	rr.m.Unlock()
+	sort.SliceStable(r, func(i, j int) bool {
+		return strings.SplitN(r[i], " ", 2)[1] < strings.SplitN(r[j], " ", 2)[1]
+	})
+	return r
+}
+
+// mockTransport responds to all requests with the JSON in buf.
+type mockTransport []byte
+
+func (t mockTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json; charset=utf-8"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(t)),
+		ContentLength: int64(len(t)),
+		Request:       r,
+	}, nil
+}
+
 type uptimeCounter time.Time
 
 func (c uptimeCounter) WritePrometheus(w io.Writer) {
@@ -0,0 +1,911 @@
+// Package latest tracks the latest Kobo firmware versions and release notes
+// from upgrade checks proxied by kfwproxy.
+//
+// To embed it, create a LatestTracker, pass upgrade check responses to
+// InterceptUpgradeCheck (e.g. from a proxy.ProxyHandler Hook), and register
+// notifiers with Notify:
+//
+//	type logNotifier struct{}
+//
+//	func (logNotifier) NotifyVersion(old, new latest.Version, devices []string) error {
+//		log.Printf("new firmware %s (was %s) for %v", new, old, devices)
+//		return nil
+//	}
+//
+//	l := latest.NewLatestTracker(0, zerolog.Nop())
+//	l.Notify(logNotifier{})
+//	l.Mount(router) // optional, serves /latest/*
+package latest
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/NYTimes/gziphandler"
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pbnjay/pixfont"
+	"github.com/rs/zerolog"
+)
+
+// LatestTracker tracks the latest firmware version and release notes from
+// intercepted upgrade checks and notifies the registered Notifiers about new
+// versions.
+type LatestTracker struct {
+	// Client is used to get the size of the upgrade package for HEAD requests
+	// to /latest/version/redir (optional, the size is omitted if nil).
+	Client *http.Client
+
+	// HistorySize and HistoryMaxAge limit the number and age of versions kept
+	// in the history (optional, unlimited if zero). The latest version is
+	// always kept.
+	HistorySize   int
+	HistoryMaxAge time.Duration
+
+	// LegacyVersionMetrics enables the kfwproxy_latest_version and
+	// kfwproxy_latest_device_version gauges (with the patch version as the
+	// value) in addition to the info metrics.
+	LegacyVersionMetrics bool
+
+	// GzipLevel is the compression level for the text endpoints (optional,
+	// default: gzip.DefaultCompression). It must be valid.
+	GzipLevel int
+
+	// BadgeMaxAge allows clients to cache the badges for this long, using an
+	// ETag for revalidation (optional, the badges aren't cached if zero).
+	BadgeMaxAge time.Duration
+
+	// SVGMaxAge is how long clients can cache /latest/version/svg if it is
+	// requested with ?nocache=0 (which omits the cache-busting timestamp) and
+	// BadgeMaxAge isn't set (optional, default: 1m).
+	SVGMaxAge time.Duration
+
+	// NotifyConcurrency limits the number of notifiers called at once
+	// (optional, default: unlimited), and NotifyRetries is the number of times
+	// to retry failed notifiers (optional).
+	NotifyConcurrency int
+	NotifyRetries     int
+
+	// ReplayNotify makes Notify immediately send the last version which was
+	// announced (if any, not including the startup version) to the newly
+	// registered notifiers, so they don't have to wait for the next one.
+	ReplayNotify bool
+
+	// BadgePrefix is the default text before the version in the SVG and PNG
+	// badges (optional, can be overridden with ?prefix=).
+	BadgePrefix string
+
+	n []Notifier
+	// note: this is more efficient than a mutex, and ordering isn't critical
+	// because we only update it for a new version and it's nearly impossible
+	// that multiple versions will be released at the exact same instant and
+	// will disappear at the next one.
+	v   atomic.Value
+	t   atomic.Value
+	nv  atomic.Value // [2]Version, the old and new versions of the last notification
+	log zerolog.Logger
+	d   time.Duration
+
+	hm sync.Mutex
+	h  []HistoryEntry // newest last
+
+	dv sync.Map // map[string]vS, the latest version per device
+	da sync.Map // map[string]vS, the latest version per device/affiliate
+	af sync.Map // map[string]vS, the latest version per affiliate
+	nd int64    // the number of keys in dv, da, and af (atomic)
+
+	nu, wu, pe uint64 // upgrade checks without and with an update, and parse errors (atomic)
+	rg         uint64 // upgrade checks with an older version than previously seen for the device (atomic)
+
+	ps sync.Map // map[string]int64, the package size per upgrade URL
+}
+
+// HistoryEntry is a version seen by a LatestTracker.
+type HistoryEntry struct {
+	Version    Version
+	UpgradeURL string
+	NotesURL   string
+	Seen       time.Time
+}
+
+type vS struct {
+	v Version
+	u string
+}
+
+type tS struct {
+	t uint64
+	u string
+}
+
+// NewLatestTracker creates a new LatestTracker which checks for new versions to
+// notify about every debounce (default: 5s). Larger values reduce false
+// positives during staged rollouts at the cost of delaying notifications.
+func NewLatestTracker(debounce time.Duration, log zerolog.Logger) *LatestTracker {
+	if debounce <= 0 {
+		debounce = time.Second * 5
+	}
+	l := &LatestTracker{log: log, d: debounce}
+
+	// note: this must be initialized in this way, as an atomic.Value can't be copied after being stored
+	l.v.Store(vS{})
+	l.t.Store(tS{})
+	l.nv.Store([2]Version{})
+
+	go l.notify()
+	return l
+}
+
+// Notify registers notifiers to be called for new versions. It must not be
+// called concurrently with new versions being detected (i.e. it should be
+// called before the tracker is used). If ReplayNotify is set, the last
+// announced version is sent to them.
+func (l *LatestTracker) Notify(n ...Notifier) {
+	l.n = append(l.n, n...)
+	if l.ReplayNotify {
+		l.replay(n)
+	}
+}
+
+// replay sends the last notification to the notifiers, with the same old and
+// new versions. Nothing is sent if the last notification was for the startup
+// version (i.e. the old version was zero), since it wasn't announced to the
+// other notifiers either, or if there wasn't one yet (in which case the new
+// notifiers will be called normally).
+func (l *LatestTracker) replay(ns []Notifier) {
+	nv := l.nv.Load().([2]Version)
+	o, v := nv[0], nv[1]
+	if o.Zero() || v.Zero() {
+		return
+	}
+	l.log.Info().
+		Str("what", "notify-replay").
+		Str("old", o.String()).
+		Str("new", v.String()).
+		Int("notifiers", len(ns)).
+		Msg("replaying last notification to new notifiers")
+	devices := l.devices(v)
+	for _, n := range ns {
+		go func(n Notifier) {
+			if err := n.NotifyVersion(o, v, devices); err != nil { // note: replays aren't retried
+				l.log.Warn().
+					Err(err).
+					Str("what", "notify-replay").
+					Str("new", v.String()).
+					Msgf("notifier %T failed", n)
+			}
+		}(n)
+	}
+}
+
+// notify watches for version changes every debounce interval. This is done to
+// prevent false positives for new versions if the affiliates are not all on the
+// same version during the first set of requests when kfwproxy starts.
+//
+// Notifiers which fail are retried on the next interval, up to NotifyRetries
+// times.
+//
+// If the release notes change without a new version, NotesNotifiers are
+// notified instead.
+func (l *LatestTracker) notify() {
+	var o, p Version
+	var ot uint64 // the notes when o was notified
+	var pending []Notifier
+	var tries int
+	for range time.Tick(l.d) {
+		n := l.v.Load().(vS).v
+		nt := l.t.Load().(tS)
+		if !o.Less(n) {
+			if nt.t != ot {
+				if ot != 0 && !o.Zero() {
+					l.notifyNotes(o, nt.u)
+				}
+				ot = nt.t
+			}
+		} else {
+			if p != n {
+				p, pending, tries = n, l.n, 0
+			}
+			l.log.Info().
+				Str("what", "notify").
+				Str("old", o.String()).
+				Str("new", n.String()).
+				Int("attempt", tries+1).
+				Msg("notifying about new version")
+			if pending = l.dispatch(pending, o, n, l.devices(n)); len(pending) == 0 || tries >= l.NotifyRetries {
+				if len(pending) != 0 {
+					l.log.Error().
+						Str("what", "notify").
+						Str("new", n.String()).
+						Int("failed", len(pending)).
+						Msg("giving up on failed notifiers")
+				}
+				l.nv.Store([2]Version{o, n})
+				o, ot, pending = n, nt.t, nil
+			}
+			tries++
+		}
+	}
+}
+
+// notifyNotes notifies the NotesNotifiers about updated release notes for v.
+func (l *LatestTracker) notifyNotes(v Version, u string) {
+	l.log.Info().
+		Str("what", "notify-notes").
+		Str("version", v.String()).
+		Str("notes", u).
+		Msg("notifying about updated release notes")
+	devices := l.devices(v)
+	for _, n := range l.n {
+		if nn, ok := n.(NotesNotifier); ok {
+			go func(nn NotesNotifier) {
+				if err := nn.NotifyNotes(v, u, devices); err != nil {
+					l.log.Warn().
+						Err(err).
+						Str("what", "notify-notes").
+						Str("version", v.String()).
+						Msgf("notifier %T failed", nn)
+				}
+			}(nn)
+		}
+	}
+}
+
+// dispatch calls the notifiers (up to NotifyConcurrency at once) and waits for
+// them to finish, returning the ones which failed.
+func (l *LatestTracker) dispatch(ns []Notifier, o, n Version, devices []string) []Notifier {
+	var wg sync.WaitGroup
+	var fm sync.Mutex
+	var failed []Notifier
+
+	c := l.NotifyConcurrency
+	if c <= 0 {
+		c = len(ns)
+	}
+	sem := make(chan struct{}, c)
+
+	for _, v := range ns {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(v Notifier) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := v.NotifyVersion(o, n, devices); err != nil {
+				l.log.Warn().
+					Err(err).
+					Str("what", "notify").
+					Str("new", n.String()).
+					Msgf("notifier %T failed", v)
+				fm.Lock()
+				failed = append(failed, v)
+				fm.Unlock()
+			}
+		}(v)
+	}
+	wg.Wait()
+	return failed
+}
+
+// Version returns the latest version, if any.
+func (l *LatestTracker) Version() Version {
+	return l.v.Load().(vS).v
+}
+
+// UpgradeURL returns the upgrade URL for the latest version, if any.
+func (l *LatestTracker) UpgradeURL() string {
+	return l.v.Load().(vS).u
+}
+
+// NotesURL returns the latest release notes URL, if any.
+func (l *LatestTracker) NotesURL() string {
+	return l.t.Load().(tS).u
+}
+
+// devices returns the devices known to have received v.
+func (l *LatestTracker) devices(v Version) []string {
+	var d []string
+	l.dv.Range(func(k, cv interface{}) bool {
+		if cv.(vS).v == v {
+			d = append(d, k.(string))
+		}
+		return true
+	})
+	sort.Strings(d)
+	return d
+}
+
+// NotifyManual sends a notification about v to all notifiers without changing
+// the tracked version. The old version is the current tracked one, or v itself
+// if there isn't one yet (so notifiers don't skip it as a startup version).
+func (l *LatestTracker) NotifyManual(v Version) {
+	o := l.v.Load().(vS).v
+	if o.Zero() {
+		o = v
+	}
+	l.log.Warn().
+		Str("what", "notify-manual").
+		Str("old", o.String()).
+		Str("new", v.String()).
+		Msg("manually notifying about version")
+	for _, n := range l.n {
+		go n.NotifyVersion(o, v, l.devices(v)) // note: manual notifications aren't retried
+	}
+}
+
+// maxTracked is the maximum total number of devices, device/affiliate pairs,
+// and affiliates to track the latest version for.
+const maxTracked = 4096
+
+var (
+	deviceRe    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	affiliateRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+)
+
+// InterceptUpgradeCheck updates the latest version and notes from an upgrade
+// check response for the specified device (optional).
+func (l *LatestTracker) InterceptUpgradeCheck(device string, buf []byte) {
+	l.InterceptAffiliateUpgradeCheck(device, "", buf)
+}
+
+// InterceptAffiliateUpgradeCheck is like InterceptUpgradeCheck, but also tracks
+// the version per affiliate (optional). Invalid device IDs and affiliates are
+// ignored.
+func (l *LatestTracker) InterceptAffiliateUpgradeCheck(device, affiliate string, buf []byte) {
+	var s struct{ UpgradeURL, ReleaseNoteURL string }
+	if err := json.Unmarshal(buf, &s); err == nil {
+		if s.UpgradeURL == "" {
+			atomic.AddUint64(&l.nu, 1)
+		} else {
+			atomic.AddUint64(&l.wu, 1)
+		}
+		if u := s.UpgradeURL; u != "" {
+			if v, err := ExtractVersion(u); err != nil {
+				atomic.AddUint64(&l.pe, 1)
+				l.log.Warn().Err(err).Str("url", u).Msg("could not extract version from upgrade check")
+			} else {
+				l.interceptVersion(device, affiliate, v, u, s.ReleaseNoteURL, "intercept-version")
+			}
+		}
+		if u := s.ReleaseNoteURL; u != "" {
+			l.interceptNotes(u, "intercept-notes")
+		}
+	} else {
+		atomic.AddUint64(&l.pe, 1)
+		l.log.Warn().Err(err).Msg("could not parse upgrade check")
+	}
+}
+
+// InterceptRelease updates the latest version and notes from an external
+// source, the same way as an intercepted upgrade check. The URLs are optional.
+func (l *LatestTracker) InterceptRelease(v Version, upgradeURL, notesURL string) {
+	l.log.Warn().
+		Str("what", "intercept-external").
+		Str("new", v.String()).
+		Str("url", upgradeURL).
+		Str("notes", notesURL).
+		Msg("externally triggered release")
+	l.interceptVersion("", "", v, upgradeURL, notesURL, "intercept-external-version")
+	if notesURL != "" {
+		l.interceptNotes(notesURL, "intercept-external-notes")
+	}
+}
+
+func (l *LatestTracker) interceptVersion(device, affiliate string, v Version, u, n, what string) {
+	// note: these come from the client, so they need to be validated to
+	// prevent them from being used to fill the maps
+	if !deviceRe.MatchString(device) {
+		device = ""
+	}
+	if !affiliateRe.MatchString(affiliate) {
+		affiliate = ""
+	}
+	// note: this is compared per-device rather than against the global latest
+	// version, since older devices are stuck on older versions
+	if cv, ok := l.dv.Load(device); device != "" && ok && v.Less(cv.(vS).v) {
+		atomic.AddUint64(&l.rg, 1)
+		l.log.Warn().
+			Str("what", what).
+			Str("device", device).
+			Str("affiliate", affiliate).
+			Str("old", cv.(vS).v.String()).
+			Str("new", v.String()).
+			Msg("version regressed")
+	}
+	if device != "" {
+		l.track(&l.dv, device, vS{v, u})
+		if affiliate != "" {
+			l.track(&l.da, device+"/"+affiliate, vS{v, u})
+			l.track(&l.af, affiliate, vS{v, u})
+		}
+	}
+	if cv := l.v.Load().(vS); cv.v.Less(v) {
+		l.log.Info().
+			Str("what", what).
+			Str("new", v.String()).
+			Str("url", u).
+			Msg("intercepted newer upgrade check version")
+		l.v.Store(vS{v, u})
+		l.record(v, u, n)
+	}
+}
+
+func (l *LatestTracker) interceptNotes(u, what string) {
+	if x := strings.LastIndex(u, "/"); x != -1 {
+		t, _ := strconv.ParseUint(u[x+1:], 10, 64)
+		if ct := l.t.Load().(tS); ct.t < t {
+			l.log.Info().
+				Str("what", what).
+				Uint64("new", t).
+				Str("url", u).
+				Msg("intercepted newer upgrade check notes")
+			l.t.Store(tS{t, u})
+		}
+	}
+}
+
+// track stores cv in m if it is newer than the current one for k. New keys
+// aren't added once maxTracked is reached.
+func (l *LatestTracker) track(m *sync.Map, k string, cv vS) {
+	if ov, ok := m.Load(k); ok {
+		if ov.(vS).v.Less(cv.v) {
+			m.Store(k, cv)
+		}
+		return
+	}
+	if atomic.AddInt64(&l.nd, 1) > maxTracked {
+		atomic.AddInt64(&l.nd, -1)
+		l.log.Debug().Str("key", k).Msg("too many devices or affiliates, not tracking")
+		return
+	}
+	if ov, loaded := m.LoadOrStore(k, cv); loaded {
+		atomic.AddInt64(&l.nd, -1)
+		if ov.(vS).v.Less(cv.v) {
+			m.Store(k, cv)
+		}
+	}
+}
+
+// record adds a version to the history if it isn't already there.
+func (l *LatestTracker) record(v Version, u, n string) {
+	l.hm.Lock()
+	defer l.hm.Unlock()
+	for _, h := range l.h {
+		if h.Version == v {
+			return
+		}
+	}
+	l.h = append(l.h, HistoryEntry{v, u, n, time.Now()})
+	sort.SliceStable(l.h, func(i, j int) bool {
+		return l.h[i].Version.Less(l.h[j].Version)
+	})
+	l.prune()
+}
+
+// prune removes the oldest versions from the history if it is over the limits.
+// The lock must be held.
+func (l *LatestTracker) prune() {
+	var x int
+	if l.HistorySize > 0 && len(l.h) > l.HistorySize {
+		x = len(l.h) - l.HistorySize
+	}
+	if l.HistoryMaxAge > 0 {
+		for t := time.Now().Add(-l.HistoryMaxAge); x < len(l.h)-1 && l.h[x].Seen.Before(t); x++ {
+		}
+	}
+	if x != 0 {
+		l.h = append(l.h[:0:0], l.h[x:]...)
+	}
+}
+
+// History returns the versions seen since kfwproxy started, newest first.
+func (l *LatestTracker) History() []HistoryEntry {
+	l.hm.Lock()
+	defer l.hm.Unlock()
+	h := make([]HistoryEntry, len(l.h))
+	for i := range l.h {
+		h[len(h)-1-i] = l.h[i]
+	}
+	return h
+}
+
+// HistoryVersion returns the history entry for a version, if it is in the
+// history.
+func (l *LatestTracker) HistoryVersion(v Version) (HistoryEntry, bool) {
+	l.hm.Lock()
+	defer l.hm.Unlock()
+	for _, h := range l.h {
+		if h.Version == v {
+			return h, true
+		}
+	}
+	return HistoryEntry{}, false
+}
+
+func (l *LatestTracker) WritePrometheus(w io.Writer) {
+	m := metrics.NewSet()
+	m.NewCounter(`kfwproxy_upgradecheck_no_update_total`).Set(atomic.LoadUint64(&l.nu))
+	m.NewCounter(`kfwproxy_upgradecheck_update_total`).Set(atomic.LoadUint64(&l.wu))
+	m.NewCounter(`kfwproxy_upgradecheck_parse_errors_total`).Set(atomic.LoadUint64(&l.pe))
+	m.NewCounter(`kfwproxy_version_regressions_total`).Set(atomic.LoadUint64(&l.rg))
+	l.hm.Lock()
+	hl := len(l.h)
+	l.hm.Unlock()
+	m.NewGauge(`kfwproxy_history_len`, func() float64 { return float64(hl) })
+	if cv := l.v.Load().(vS); !cv.v.Zero() {
+		m.NewGauge(`kfwproxy_latest_version_info{version="`+cv.v.String()+`"}`, func() float64 { return 1 })
+		if l.LegacyVersionMetrics {
+			m.NewGauge(`kfwproxy_latest_version{full="`+cv.v.String()+`"}`, func() float64 { return float64(int(cv.v[2])) })
+		}
+	}
+	l.dv.Range(func(k, v interface{}) bool {
+		// note: only valid device IDs are tracked (see interceptVersion), so
+		// the number of series is bounded
+		cv := v.(vS)
+		m.NewGauge(`kfwproxy_latest_device_version_info{device=`+strconv.Quote(k.(string))+`,version="`+cv.v.String()+`"}`, func() float64 { return 1 })
+		if l.LegacyVersionMetrics {
+			m.NewGauge(`kfwproxy_latest_device_version{device=`+strconv.Quote(k.(string))+`,full="`+cv.v.String()+`"}`, func() float64 { return float64(int(cv.v[2])) })
+		}
+		return true
+	})
+	if ct := l.t.Load().(tS); ct.t != 0 {
+		m.NewGauge(`kfwproxy_latest_notes`, func() float64 { return float64(int(ct.t)) })
+	}
+	m.WritePrometheus(w)
+}
+
+// serveHistoryVersion responds with the URLs for a version in the history as
+// JSON, or a 404 if it isn't in the history.
+func (l *LatestTracker) serveHistoryVersion(w http.ResponseWriter, version string) {
+	v, err := ExtractVersion(version)
+	if err == nil && v.Zero() {
+		err = fmt.Errorf("no version in %#v", version)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "invalid version: " + err.Error(),
+		})
+		return
+	}
+	for _, h := range l.History() {
+		if h.Version == v {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"version":     h.Version.String(),
+				"upgrade_url": h.UpgradeURL,
+				"notes_url":   h.NotesURL,
+				"seen":        h.Seen.UTC().Format(time.RFC3339),
+			})
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": "version " + v.String() + " not in history",
+	})
+}
+
+// Router is the part of httprouter.Router used by Mount.
+type Router interface {
+	Handle(method, path string, handle httprouter.Handle)
+}
+
+// Mount registers the /latest endpoints on r (usually an httprouter.Router).
+func (l *LatestTracker) Mount(r Router) {
+	// gz compresses the response if supported by the client (this is only used
+	// for text endpoints which can get large, not the badges)
+	gl := l.GzipLevel
+	if gl == 0 {
+		gl = gzip.DefaultCompression
+	}
+	gzh := gziphandler.MustNewGzipLevelHandler(gl)
+	gz := func(h httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			gzh(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h(w, r, p)
+			})).ServeHTTP(w, r)
+		}
+	}
+
+	r.Handle("GET", "/latest/notes", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		fmt.Fprintf(w, "%d", l.t.Load().(tS).t)
+	})
+
+	r.Handle("GET", "/latest/version", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if v, ok := r.URL.Query()["version"]; ok {
+			gz(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+				l.serveHistoryVersion(w, v[0])
+			})(w, r, p)
+			return
+		}
+		fmt.Fprintf(w, "%s", l.v.Load().(vS).v)
+	})
+
+	r.Handle("GET", "/latest/version/svg", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		fn := func(p, d string) string {
+			if v := r.URL.Query().Get(p); v != "" {
+				return strings.ReplaceAll(v, `"`, `'`)
+			}
+			return d
+		}
+		fw := fn("fw", "72")
+		fh := fn("fh", "12")
+		ff := fn("ff", "Verdana, Arial, Helvetica, sans-serif")
+		fc := fn("fc", "#000")
+
+		// the default width fits the version, so extend it for the prefix
+		// (assuming an average character width of 0.6em)
+		txt, pfx := l.badgeText(r)
+		if _, ok := r.URL.Query()["fw"]; !ok && pfx != "" {
+			if h, err := strconv.ParseFloat(fh, 64); err == nil {
+				fw = strconv.Itoa(72 + int(math.Ceil(float64(utf8.RuneCountInString(pfx))*h*0.6)))
+			}
+		}
+
+		// theme=auto switches to fcd (default: #fff) if the viewer prefers a
+		// dark color scheme (the fill attribute is kept for renderers which
+		// don't support CSS)
+		var st string
+		if r.URL.Query().Get("theme") == "auto" {
+			st = fmt.Sprintf(`<style>text{fill:%s}@media (prefers-color-scheme: dark){text{fill:%s}}</style>`, cssValue(fc), cssValue(fn("fcd", "#fff")))
+		}
+
+		// nocache=0 omits the timestamp comment (which is there to bust
+		// caches which ignore the headers), and allows caching it briefly
+		var ts string
+		ma := l.BadgeMaxAge
+		if r.URL.Query().Get("nocache") != "0" {
+			ts = "<!--" + time.Now().String() + "-->"
+		} else if ma <= 0 {
+			if ma = l.SVGMaxAge; ma <= 0 {
+				ma = time.Minute
+			}
+		}
+
+		w.Header().Set("Content-Type", "image/svg+xml")
+		if l.badgeCache(w, r, ma) {
+			return
+		}
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><svg xmlns="http://www.w3.org/2000/svg" version="1.1" width="%s" height="%s">%s<text x="0" y="%s" font-size="%s" font-family="%s" fill="%s">%s</text>%s</svg>`, fw, fh, st, fh, fh, ff, fc, html.EscapeString(txt), ts)
+	})
+
+	r.Handle("GET", "/latest/version/shield.json", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		fn := func(p, d string) string {
+			if v := r.URL.Query().Get(p); v != "" {
+				return v
+			}
+			return d
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if l.badgeCache(w, r, l.BadgeMaxAge) {
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"schemaVersion": 1,
+			"label":         fn("label", "kobo firmware"),
+			"message":       l.v.Load().(vS).v.String(),
+			"color":         fn("color", "blue"),
+		})
+	})
+
+	r.Handle("GET", "/latest/version/png", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.Header().Set("Content-Type", "image/png")
+		if l.badgeCache(w, r, l.BadgeMaxAge) {
+			return
+		}
+		var fg, bg color.Color = color.Black, color.Transparent
+		if c, ok := parseHexColor(r.URL.Query().Get("fg")); ok {
+			fg = c
+		}
+		if c, ok := parseHexColor(r.URL.Query().Get("bg")); ok {
+			bg = c
+		}
+		font := pixfont.Font8x8
+		v, _ := l.badgeText(r)
+		iw, ih := font.MeasureString(v), font.GetHeight()
+		img := image.NewRGBA(image.Rect(0, 0, iw, ih))
+		draw.Draw(img, img.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+		font.DrawString(img, 0, 0, v, fg)
+		png.Encode(w, img)
+	})
+
+	// note: this is an alias for /latest/version?version= (which is needed
+	// since the version can't be a path parameter under /latest/version due to
+	// the badge routes)
+	r.Handle("GET", "/latest/history/:version", gz(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		l.serveHistoryVersion(w, p.ByName("version"))
+	}))
+
+	r.Handle("GET", "/latest/changelog.txt", gz(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		for _, h := range l.History() {
+			fmt.Fprintf(w, "%s\t%s\n", h.Version, h.Seen.UTC().Format(time.RFC3339))
+		}
+	}))
+
+	r.Handle("GET", "/latest/history.csv", gz(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `inline; filename="history.csv"`)
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"version", "first_seen_timestamp", "upgrade_url", "notes_url"})
+		for _, h := range l.History() {
+			cw.Write([]string{h.Version.String(), h.Seen.UTC().Format(time.RFC3339), h.UpgradeURL, h.NotesURL})
+		}
+		cw.Flush()
+	}))
+
+	r.Handle("GET", "/latest/notes/redir", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		http.Redirect(w, r, l.t.Load().(tS).u, http.StatusTemporaryRedirect)
+	})
+
+	r.Handle("GET", "/latest/version/redir", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		cv, ok := l.lookup(r.URL.Query().Get("device"), r.URL.Query().Get("affiliate"))
+		if !ok {
+			http.Error(w, "No version found for the device and affiliate", http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, cv.u, http.StatusTemporaryRedirect)
+	})
+
+	r.Handle("HEAD", "/latest/version/redir", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		cv, ok := l.lookup(r.URL.Query().Get("device"), r.URL.Query().Get("affiliate"))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !cv.v.Zero() {
+			w.Header().Set("X-KFWProxy-Version", cv.v.String())
+			if n, ok := l.packageSize(r, cv.u); ok {
+				w.Header().Set("X-KFWProxy-Package-Size", strconv.FormatInt(n, 10))
+			}
+		}
+		w.Header().Set("Location", cv.u)
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	})
+}
+
+// lookup gets the latest version for the device and/or affiliate, or the
+// global latest version if neither is specified.
+func (l *LatestTracker) lookup(device, affiliate string) (vS, bool) {
+	switch {
+	case device == "" && affiliate == "":
+		return l.v.Load().(vS), true
+	case affiliate == "":
+		cv, ok := l.dv.Load(device)
+		if !ok {
+			return vS{}, false
+		}
+		return cv.(vS), true
+	case device == "":
+		cv, ok := l.af.Load(affiliate)
+		if !ok {
+			return vS{}, false
+		}
+		return cv.(vS), true
+	default:
+		cv, ok := l.da.Load(device + "/" + affiliate)
+		if !ok {
+			return vS{}, false
+		}
+		return cv.(vS), true
+	}
+}
+
+// packageSize gets the size of the upgrade package at u using a HEAD request.
+// The result is remembered, since the package for a URL never changes.
+func (l *LatestTracker) packageSize(r *http.Request, u string) (int64, bool) {
+	if l.Client == nil || u == "" {
+		return 0, false
+	}
+	if n, ok := l.ps.Load(u); ok {
+		return n.(int64), true
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodHead, u, nil)
+	if err != nil {
+		return 0, false
+	}
+	resp, err := l.Client.Do(req)
+	if err != nil {
+		l.log.Warn().Err(err).Str("url", u).Msg("could not get package size")
+		return 0, false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		l.log.Warn().Int("status", resp.StatusCode).Str("url", u).Msg("could not get package size")
+		return 0, false
+	}
+
+	l.ps.Store(u, resp.ContentLength)
+	return resp.ContentLength, true
+}
+
+// badgeCache sets the caching headers for a badge which can be cached for
+// maxAge (usually BadgeMaxAge), and responds with 304 Not Modified (returning
+// true) if the client already has the current version.
+func (l *LatestTracker) badgeCache(w http.ResponseWriter, r *http.Request, maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		w.Header().Set("Cache-Control", "no-store, must-revalidate")
+		return false
+	}
+	etag := `"` + l.v.Load().(vS).v.String() + `"`
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge.Seconds())))
+	w.Header().Set("ETag", "W/"+etag) // weak since the body may differ (e.g. the SVG timestamp), but it's semantically the same
+	for _, v := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if v = strings.TrimPrefix(strings.TrimSpace(v), "W/"); v == etag || v == "*" {
+			w.Header().Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// badgeText returns the text for a badge and the prefix used.
+func (l *LatestTracker) badgeText(r *http.Request) (string, string) {
+	pfx := l.BadgePrefix
+	if v, ok := r.URL.Query()["prefix"]; ok {
+		pfx = v[0]
+	}
+	v := l.v.Load().(vS).v.String()
+	if pfx != "" {
+		return pfx + " " + v, pfx
+	}
+	return v, pfx
+}
+
+// cssValue removes characters which could escape a CSS value in a style
+// element.
+func cssValue(s string) string {
+	return strings.NewReplacer("<", "", ">", "", "&", "", "{", "", "}", "", ";", "").Replace(s)
+}
+
+// parseHexColor parses a color in the format rgb, rgba, rrggbb, or rrggbbaa,
+// optionally prefixed with #.
+func parseHexColor(s string) (color.Color, bool) {
+	s = strings.TrimPrefix(s, "#")
+	switch len(s) {
+	case 3, 4:
+		var b []byte
+		for _, c := range s {
+			b = append(b, byte(c), byte(c))
+		}
+		s = string(b)
+	case 6, 8:
+	default:
+		return nil, false
+	}
+	if len(s) == 6 {
+		s += "ff"
+	}
+	n, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return nil, false
+	}
+	return color.NRGBA{uint8(n >> 24), uint8(n >> 16), uint8(n >> 8), uint8(n)}, true
+}
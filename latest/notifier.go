@@ -0,0 +1,20 @@
+package latest
+
+// Notifier is notified by a LatestTracker about new versions.
+type Notifier interface {
+	// NotifyVersion notifies about a new version. The devices which are known
+	// to have received the new version are passed for filtering (it may be
+	// empty if the version didn't come from an upgrade check). If an error is
+	// returned, it may be called again for the same version, so it should only
+	// return one if nothing was sent.
+	NotifyVersion(old, new Version, devices []string) error
+}
+
+// NotesNotifier can optionally be implemented by a Notifier to be notified when
+// the release notes are updated without a new version.
+type NotesNotifier interface {
+	// NotifyNotes notifies about updated release notes for the latest version.
+	// The devices are the same as for NotifyVersion. Notes updates aren't
+	// retried.
+	NotifyNotes(v Version, notesURL string, devices []string) error
+}
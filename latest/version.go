@@ -0,0 +1,113 @@
+package latest
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"sync/atomic"
+)
+
+type Version [3]uint64
+
+// VersionPattern is the default regexp for extracting versions.
+const VersionPattern = `([0-9]+)\.([0-9]+)(?:\.([0-9]+))?`
+
+var versionRe atomic.Value // *regexp.Regexp
+
+func init() {
+	versionRe.Store(regexp.MustCompile(VersionPattern))
+}
+
+// SetVersionPattern replaces the regexp used for extracting versions. It must
+// have two or three capture groups (the last one may be optional) which only
+// match digits. It should be called before any versions are extracted.
+func SetVersionPattern(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	if n := re.NumSubexp(); n != 2 && n != 3 {
+		return fmt.Errorf("expected 2 or 3 capture groups, got %d", n)
+	}
+	st, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return err
+	}
+	if !digitGroups(st, false) {
+		return fmt.Errorf("capture groups must only match digits")
+	}
+	versionRe.Store(re)
+	return nil
+}
+
+// digitGroups checks that the capture groups in re can only match digits.
+func digitGroups(re *syntax.Regexp, capture bool) bool {
+	if re.Op == syntax.OpCapture {
+		capture = true
+	}
+	if capture {
+		switch re.Op {
+		case syntax.OpLiteral:
+			for _, c := range re.Rune {
+				if c < '0' || c > '9' {
+					return false
+				}
+			}
+		case syntax.OpCharClass:
+			for i := 0; i < len(re.Rune); i += 2 {
+				if re.Rune[i] < '0' || re.Rune[i+1] > '9' {
+					return false
+				}
+			}
+		case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+			return false
+		}
+	}
+	for _, sub := range re.Sub {
+		if !digitGroups(sub, capture) {
+			return false
+		}
+	}
+	return true
+}
+
+// ExtractVersion extracts the first version from str. If there isn't one, the
+// zero Version is returned. An error is returned if a component is out of
+// range.
+func ExtractVersion(str string) (Version, error) {
+	m := versionRe.Load().(*regexp.Regexp).FindStringSubmatch(str)
+	var v Version
+	var err error
+	for i := range v {
+		if i+1 < len(m) && m[i+1] != "" {
+			v[i], err = strconv.ParseUint(m[i+1], 10, 64)
+			if err != nil {
+				return Version{}, fmt.Errorf("parse version component %#v: %w", m[i+1], err)
+			}
+		}
+	}
+	return v, nil
+}
+
+// MustExtractVersion is like ExtractVersion, but panics on error. It must not
+// be used on untrusted input.
+func MustExtractVersion(str string) Version {
+	v, err := ExtractVersion(str)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+func (v Version) Less(w Version) bool {
+	return !(v[0] > w[0] || (v[0] == w[0] && (v[1] > w[1] || (v[1] == w[1] && (v[2] > w[2] || v[2] == w[2])))))
+}
+
+func (v Version) Zero() bool {
+	return v[0] == 0 && v[1] == 0 && v[2] == 0
+}
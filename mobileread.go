@@ -7,6 +7,8 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 )
@@ -15,11 +17,12 @@ import (
 type MobileRead struct {
 	c    *http.Client
 	u, p string
+	lt   int64 // unix time of the last successful login check (atomic)
 }
 
 // NewMobileRead creates a new client and logs in.
 func NewMobileRead(c *http.Client, username, password string) (*MobileRead, error) {
-	mr := &MobileRead{c, username, password}
+	mr := &MobileRead{c: c, u: username, p: password}
 	if c.Jar == nil {
 		return nil, fmt.Errorf("http client does not have a cookie jar")
 	}
@@ -38,6 +41,17 @@ func (mr *MobileRead) Login() error {
 	return mr.login(false, false, false)
 }
 
+// LastLogin returns the last time the user was successfully logged in, or the
+// zero time if never.
+func (mr *MobileRead) LastLogin() time.Time {
+	if lt := atomic.LoadInt64(&mr.lt); lt != 0 {
+		return time.Unix(lt, 0)
+	}
+	return time.Time{}
+}
+
+// NewThread posts a new thread and returns its ID. If the thread was posted but
+// is awaiting moderation, the ID is 0 and the error is nil.
 func (mr *MobileRead) NewThread(forum int, subject, message, tagList string, signature, parseURL, disableSmilies bool) (int, error) {
 	if err := mr.Login(); err != nil {
 		return 0, fmt.Errorf("log in: %w", err)
@@ -157,6 +171,12 @@ func (mr *MobileRead) NewThread(forum int, subject, message, tagList string, sig
 		return 0, fmt.Errorf("parse thread page: %w", err)
 	}
 
+	// the thread was posted, but it needs to be approved before being visible
+	// (vBulletin shows a redirect page instead of the thread)
+	if txt := strings.ToLower(tdoc.Text()); strings.Contains(txt, "moderator has approved") || strings.Contains(txt, "after approval") {
+		return 0, nil
+	}
+
 	if strings.Contains(tresp.Request.URL.Path, "newthread.php") {
 		return 0, fmt.Errorf("unknown error posting thread")
 	}
@@ -210,11 +230,13 @@ func (mr *MobileRead) login(checkLogin, forceLogin, expectLogin bool) error {
 			break
 		default:
 			if checkLogin {
+				atomic.StoreInt64(&mr.lt, time.Now().Unix())
 				return nil
 			}
 			if expectLogin {
 				return fmt.Errorf("parse login page: expected logged out user, but got security token %q for logged in user", s.AttrOr("value", ""))
 			}
+			atomic.StoreInt64(&mr.lt, time.Now().Unix())
 			return nil
 		}
 	}
@@ -2,15 +2,34 @@ package main
 
 import (
 	"fmt"
+	"html"
 	"io"
+	"math/rand"
+	"path"
 	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/VictoriaMetrics/metrics"
+	"github.com/pgaskin/kfwproxy/latest"
 	"github.com/rs/zerolog"
 )
 
-type Notifier interface {
-	NotifyVersion(old, new Version)
+// matchDevices checks if any device matches any of the patterns (see
+// path.Match). If there aren't any patterns, it always matches.
+func matchDevices(patterns, devices []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		for _, d := range devices {
+			if ok, _ := path.Match(p, d); ok {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 type TelegramNotifier struct {
@@ -18,20 +37,43 @@ type TelegramNotifier struct {
 	c   map[string]*cS
 	m   *metrics.Set
 	log zerolog.Logger
+
+	// Buttons, if set, returns the inline keyboard buttons to attach to the
+	// message about the new version.
+	Buttons func(new latest.Version) []TelegramButton
+
+	// ParseMode is the format to send messages in (HTML or MarkdownV2). If
+	// empty, HTML is used.
+	ParseMode string
+
+	// LinkPreview enables the link preview for messages.
+	LinkPreview bool
+
+	// NotesUpdates enables messages about release notes updated without a new
+	// version.
+	NotesUpdates bool
+
+	// Devices optionally limits chats to versions for devices matching any of
+	// the patterns (see path.Match).
+	Devices map[string][]string
 }
 
 type cS struct {
 	f    bool
 	c, u string
+	a    []string // the chats which resolved to this one (including c)
 	s, e *metrics.Counter
 }
 
 // NewTelegramNotifier creates a new TelegramNotifier. If any chats failed to
 // register, each error is returned in the list. All chats in forcedChats must
-// also be in chats or it will panic.
+// also be in chats or it will panic. Chats which resolve to the same chat (e.g.
+// the numeric ID and the @username) are merged.
 func NewTelegramNotifier(t *Telegram, chats []string, forcedChats []string, log zerolog.Logger) (*TelegramNotifier, []error) {
 	var errs []error
 	ac := make(map[string]*cS, len(chats))
+	ai := make(map[int64]*cS, len(chats))  // by resolved ID
+	al := make(map[string]*cS, len(chats)) // by any chat which resolved to it
 
 	m := metrics.NewSet()
 	m.NewGauge(`kfwproxy_telegram_chats_registered_count{bot="`+t.GetUsername()+`"}`, func() float64 { return float64(len(ac)) })
@@ -39,16 +81,26 @@ func NewTelegramNotifier(t *Telegram, chats []string, forcedChats []string, log
 
 	log.Info().Msg("Initializing chats")
 	for _, c := range chats {
-		if _, ok := ac[c]; ok {
+		if _, ok := al[c]; ok {
 			log.Fatal().Msgf("Duplicate chat %#v", c)
 			panic("")
 		}
-		u, err := t.GetChatUsername(c)
+		id, u, err := t.GetChat(c)
 		if err != nil {
 			errs = append(errs, fmt.Errorf("initialize chat %#v: %w", c, err))
 			log.Err(err).Msgf("Could not initialize chat %#v", c)
 			continue
 		}
+		if dc, ok := ai[id]; ok {
+			log.Warn().
+				Str("id", c).
+				Str("duplicate", dc.c).
+				Int64("chat_id", id).
+				Msgf("Chat %#v is the same as %#v (%s), merging them", c, dc.c, u)
+			dc.a = append(dc.a, c)
+			al[c] = dc
+			continue
+		}
 		log.Info().
 			Str("id", c).
 			Str("username", u).
@@ -57,9 +109,11 @@ func NewTelegramNotifier(t *Telegram, chats []string, forcedChats []string, log
 			f: false,
 			c: c,
 			u: u,
-			s: m.NewCounter(`kfwproxy_telegram_messages_sent_total{bot="` + t.GetUsername() + `",chat="` + u + `"}`),
-			e: m.NewCounter(`kfwproxy_telegram_messages_errored_total{bot="` + t.GetUsername() + `",chat="` + u + `"}`),
+			a: []string{c},
+			s: m.NewCounter(`kfwproxy_telegram_messages_sent_total{bot="` + t.GetUsername() + `",chat=` + strconv.Quote(u) + `}`),
+			e: m.NewCounter(`kfwproxy_telegram_messages_errored_total{bot="` + t.GetUsername() + `",chat=` + strconv.Quote(u) + `}`),
 		}
+		ai[id], al[c] = ac[c], ac[c]
 	}
 
 	for _, fc := range forcedChats {
@@ -73,19 +127,25 @@ func NewTelegramNotifier(t *Telegram, chats []string, forcedChats []string, log
 		if !f {
 			panic(fmt.Sprintf("chat %#v is not in %+s", fc, chats))
 		}
-		if _, ok := ac[fc]; ok {
-			ac[fc].f = true
+		if c, ok := al[fc]; ok {
+			c.f = true
 		}
 	}
 
-	return &TelegramNotifier{t, ac, m, log}, errs
+	return &TelegramNotifier{t: t, c: ac, m: m, log: log}, errs
 }
 
-func (t *TelegramNotifier) NotifyVersion(old, new Version) {
+func (t *TelegramNotifier) NotifyVersion(old, new latest.Version, devices []string) error {
 	t.log.Info().
 		Str("old", old.String()).
 		Str("new", new.String()).
 		Msgf("sending notifications about %s", new)
+	var buttons []TelegramButton
+	if t.Buttons != nil {
+		buttons = t.Buttons(new)
+	}
+	var sent int
+	var errs []error
 	for _, c := range t.c {
 		if old.Zero() && !c.f {
 			t.log.Info().
@@ -94,16 +154,101 @@ func (t *TelegramNotifier) NotifyVersion(old, new Version) {
 				Msgf("not sending message to %s (%s) about (%s, %s) since original version is zero (i.e. kfwproxy just started)", c.u, c.c, old, new)
 			continue
 		}
+		if !t.matchDevices(c, devices) {
+			t.log.Info().
+				Str("id", c.c).
+				Str("username", c.u).
+				Strs("devices", devices).
+				Msgf("not sending message to %s (%s) about (%s, %s) since no devices match the filter", c.u, c.c, old, new)
+			t.m.GetOrCreateCounter(`kfwproxy_telegram_messages_filtered_total{bot="` + t.t.GetUsername() + `",chat=` + strconv.Quote(c.u) + `}`).Inc()
+			continue
+		}
 		t.log.Info().
 			Str("id", c.c).
 			Str("username", c.u).
 			Msgf("sending message to %s (%s) about (%s, %s)", c.u, c.c, old, new)
-		if err := t.t.SendMessage(c.c, fmt.Sprintf(`Kobo firmware <b>%s</b> has been released!`+"\n"+`<a href="https://pgaskin.net/KoboStuff/kobofirmware.html">More information.</a>`, new)); err != nil {
+		if err := t.t.SendMessageWithButtons(c.c, t.message(new), t.parseMode(), t.LinkPreview, buttons); err != nil {
 			c.e.Inc()
+			errs = append(errs, err)
 		} else {
 			c.s.Inc()
+			sent++
+		}
+	}
+	if sent == 0 && len(errs) != 0 {
+		return fmt.Errorf("send messages: all %d failed (first: %w)", len(errs), errs[0])
+	}
+	return nil
+}
+
+func (t *TelegramNotifier) NotifyNotes(v latest.Version, notesURL string, devices []string) error {
+	if !t.NotesUpdates {
+		return nil
+	}
+	t.log.Info().
+		Str("version", v.String()).
+		Str("notes", notesURL).
+		Msgf("sending notifications about updated release notes for %s", v)
+	var sent int
+	var errs []error
+	for _, c := range t.c {
+		if !t.matchDevices(c, devices) {
+			t.m.GetOrCreateCounter(`kfwproxy_telegram_messages_filtered_total{bot="` + t.t.GetUsername() + `",chat=` + strconv.Quote(c.u) + `}`).Inc()
+			continue
+		}
+		t.log.Info().
+			Str("id", c.c).
+			Str("username", c.u).
+			Msgf("sending message to %s (%s) about release notes for %s", c.u, c.c, v)
+		if err := t.t.SendMessageWithButtons(c.c, t.notesMessage(v, notesURL), t.parseMode(), t.LinkPreview, nil); err != nil {
+			c.e.Inc()
+			errs = append(errs, err)
+		} else {
+			c.s.Inc()
+			sent++
+		}
+	}
+	if sent == 0 && len(errs) != 0 {
+		return fmt.Errorf("send messages: all %d failed (first: %w)", len(errs), errs[0])
+	}
+	return nil
+}
+
+// matchDevices checks if the devices match the filter for any of the chats
+// merged into c.
+func (t *TelegramNotifier) matchDevices(c *cS, devices []string) bool {
+	for _, a := range c.a {
+		if matchDevices(t.Devices[a], devices) {
+			return true
 		}
 	}
+	return false
+}
+
+func (t *TelegramNotifier) parseMode() string {
+	if t.ParseMode == "" {
+		return "HTML"
+	}
+	return t.ParseMode
+}
+
+func (t *TelegramNotifier) message(new latest.Version) string {
+	const u = "https://pgaskin.net/KoboStuff/kobofirmware.html"
+	switch t.parseMode() {
+	case "MarkdownV2":
+		return fmt.Sprintf(`Kobo firmware *%s* has been released%s`+"\n"+`[%s](%s)`, TelegramEscapeMarkdownV2(new.String()), TelegramEscapeMarkdownV2("!"), TelegramEscapeMarkdownV2("More information."), TelegramEscapeMarkdownV2URL(u))
+	default:
+		return fmt.Sprintf(`Kobo firmware <b>%s</b> has been released!`+"\n"+`<a href="%s">More information.</a>`, new, u)
+	}
+}
+
+func (t *TelegramNotifier) notesMessage(v latest.Version, notesURL string) string {
+	switch t.parseMode() {
+	case "MarkdownV2":
+		return fmt.Sprintf(`Release notes updated for Kobo firmware *%s*`+"\n"+`[%s](%s)`, TelegramEscapeMarkdownV2(v.String()), TelegramEscapeMarkdownV2("Release notes."), TelegramEscapeMarkdownV2URL(notesURL))
+	default:
+		return fmt.Sprintf(`Release notes updated for Kobo firmware <b>%s</b>`+"\n"+`<a href="%s">Release notes.</a>`, v, html.EscapeString(notesURL))
+	}
 }
 
 func (t *TelegramNotifier) WritePrometheus(w io.Writer) {
@@ -111,26 +256,55 @@ func (t *TelegramNotifier) WritePrometheus(w io.Writer) {
 }
 
 type MobileReadNotifier struct {
-	mr  *MobileRead
-	f   map[int]*fS
-	m   *metrics.Set
-	log zerolog.Logger
+	mr   *MobileRead
+	f    map[int]*fS
+	st   *template.Template
+	tags string
+	m    *metrics.Set
+	log  zerolog.Logger
+
+	// Devices optionally limits forums to versions for devices matching any
+	// of the patterns (see path.Match).
+	Devices map[int][]string
+
+	// Signature is the BBCode appended to threads (default:
+	// MobileReadSignature). If empty, it is omitted.
+	Signature string
 }
 
+// MobileReadSubjectTemplate is the default subject template for threads. It is
+// executed with a struct containing the Version.
+const MobileReadSubjectTemplate = `Firmware {{.Version}}`
+
+// MobileReadTags is the default tag list for threads.
+const MobileReadTags = `firmware, firmware release`
+
+// MobileReadSignature is the default signature for threads.
+const MobileReadSignature = `[SIZE=1][COLOR=#999][I]Automatically posted by [URL="https://kfw.api.pgaskin.net"]kfwproxy[/URL].[/I][/COLOR][/SIZE]`
+
 type fS struct {
-	f    bool
-	fi   int
-	s, e *metrics.Counter
+	f       bool
+	fi      int
+	s, p, e *metrics.Counter
 }
 
-func NewMobileReadNotifier(mr *MobileRead, forums []int, forcedForums []int, log zerolog.Logger) (*MobileReadNotifier, []error) {
+// NewMobileReadNotifier creates a new MobileReadNotifier. The subject template
+// (see MobileReadSubjectTemplate) must be valid.
+func NewMobileReadNotifier(mr *MobileRead, forums []int, forcedForums []int, subjectTemplate *template.Template, tags string, log zerolog.Logger) (*MobileReadNotifier, []error) {
 	var errs []error
 	af := make(map[int]*fS, len(forums))
 
 	m := metrics.NewSet()
 	m.NewGauge(`kfwproxy_mobileread_forums_count{username="`+mr.GetUsername()+`"}`, func() float64 { return float64(len(af)) })
+	m.NewGauge(`kfwproxy_mobileread_session_age_seconds{username="`+mr.GetUsername()+`"}`, func() float64 {
+		if lt := mr.LastLogin(); !lt.IsZero() {
+			return time.Now().Sub(lt).Seconds()
+		}
+		return 0
+	})
 
 	if err := mr.Login(); err != nil {
+		errs = append(errs, fmt.Errorf("log in as %#v: %w", mr.GetUsername(), err))
 		log.Err(err).Msg("could not log into MobileRead")
 	}
 
@@ -147,6 +321,7 @@ func NewMobileReadNotifier(mr *MobileRead, forums []int, forcedForums []int, log
 			f:  false,
 			fi: fi,
 			s:  m.NewCounter(`kfwproxy_mobileread_threads_posted_total{username="` + mr.GetUsername() + `",forum="` + strconv.Itoa(fi) + `"}`),
+			p:  m.NewCounter(`kfwproxy_mobileread_threads_pending_total{username="` + mr.GetUsername() + `",forum="` + strconv.Itoa(fi) + `"}`),
 			e:  m.NewCounter(`kfwproxy_mobileread_threads_errored_total{username="` + mr.GetUsername() + `",forum="` + strconv.Itoa(fi) + `"}`),
 		}
 	}
@@ -167,14 +342,16 @@ func NewMobileReadNotifier(mr *MobileRead, forums []int, forcedForums []int, log
 		}
 	}
 
-	return &MobileReadNotifier{mr, af, m, log}, errs
+	return &MobileReadNotifier{mr: mr, f: af, st: subjectTemplate, tags: tags, m: m, log: log, Signature: MobileReadSignature}, errs
 }
 
-func (m *MobileReadNotifier) NotifyVersion(old, new Version) {
+func (m *MobileReadNotifier) NotifyVersion(old, new latest.Version, devices []string) error {
 	m.log.Info().
 		Str("old", old.String()).
 		Str("new", new.String()).
 		Msgf("posting threads about %s", new)
+	var sent int
+	var errs []error
 	for _, f := range m.f {
 		if old.Zero() && !f.f {
 			m.log.Info().
@@ -182,20 +359,69 @@ func (m *MobileReadNotifier) NotifyVersion(old, new Version) {
 				Msgf("not posting thread to %d about (%s, %s) since original version is zero (i.e. kfwproxy just started)", f.fi, old, new)
 			continue
 		}
+		if !matchDevices(m.Devices[f.fi], devices) {
+			m.log.Info().
+				Int("forum", f.fi).
+				Strs("devices", devices).
+				Msgf("not posting thread to %d about (%s, %s) since no devices match the filter", f.fi, old, new)
+			m.m.GetOrCreateCounter(`kfwproxy_mobileread_threads_filtered_total{username="` + m.mr.GetUsername() + `",forum="` + strconv.Itoa(f.fi) + `"}`).Inc()
+			continue
+		}
 		m.log.Info().
 			Int("forum", f.fi).
 			Msgf("posting thread to %d about (%s, %s)", f.fi, old, new)
-		if tid, err := m.mr.NewThread(f.fi, fmt.Sprintf(`Firmware %s`, new), fmt.Sprintf(`Firmware %s has been released.`+"\n\n"+`[SIZE=1][COLOR=#999][I]Automatically posted by [URL="https://kfw.api.pgaskin.net"]kfwproxy[/URL].[/I][/COLOR][/SIZE]`, new), "firmware, firmware release", true, false, true); err != nil {
+		if tid, err := m.mr.NewThread(f.fi, m.subject(new), m.message(new), m.tags, true, false, true); err != nil {
 			f.e.Inc()
+			errs = append(errs, err)
 			m.log.Info().
 				Err(err).
 				Msgf("failed to post thread")
+		} else if tid == 0 {
+			f.p.Inc()
+			sent++
+			m.log.Info().
+				Int("forum", f.fi).
+				Msgf("posted thread in forum %d, pending approval", f.fi)
 		} else {
 			f.s.Inc()
 			m.log.Info().
 				Int("forum", f.fi).
 				Int("thread", tid).
 				Msgf("posted thread %d in forum %d", tid, f.fi)
+			sent++
+		}
+	}
+	if sent == 0 && len(errs) != 0 {
+		return fmt.Errorf("post threads: all %d failed (first: %w)", len(errs), errs[0])
+	}
+	return nil
+}
+
+func (m *MobileReadNotifier) subject(new latest.Version) string {
+	var b strings.Builder
+	if err := m.st.Execute(&b, struct{ Version latest.Version }{new}); err != nil {
+		m.log.Err(err).Msg("could not execute subject template, using default")
+		return fmt.Sprintf(`Firmware %s`, new)
+	}
+	return b.String()
+}
+
+func (m *MobileReadNotifier) message(new latest.Version) string {
+	if m.Signature == "" {
+		return fmt.Sprintf(`Firmware %s has been released.`, new)
+	}
+	return fmt.Sprintf(`Firmware %s has been released.`+"\n\n"+`%s`, new, m.Signature)
+}
+
+// KeepAlive ensures the user is logged in every interval (with up to 10%
+// jitter) so the session doesn't go stale between releases. It does not return.
+func (m *MobileReadNotifier) KeepAlive(interval time.Duration) {
+	for {
+		time.Sleep(interval + time.Duration(rand.Int63n(int64(interval/5)+1)) - interval/10)
+		if err := m.mr.Login(); err != nil {
+			m.log.Err(err).Msg("could not refresh MobileRead session")
+		} else {
+			m.log.Info().Msg("refreshed MobileRead session")
 		}
 	}
 }
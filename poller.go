@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/rs/zerolog"
+)
+
+// Poller periodically makes upgrade checks through the proxy (so they go
+// through the cache and the LatestTracker hook) to keep the latest versions
+// fresh even without client traffic.
+type Poller struct {
+	h   http.Handler
+	t   []*pT
+	i   time.Duration
+	log zerolog.Logger
+	m   *metrics.Set
+}
+
+type pT struct {
+	d, a string
+	u    string
+	last int64 // unix time of the last successful poll (atomic)
+}
+
+// NewPoller creates a new Poller for the specified targets (in the format
+// device/affiliate/version/serial, which must be valid) which makes requests to
+// h every interval.
+func NewPoller(h http.Handler, targets []string, interval time.Duration, log zerolog.Logger) *Poller {
+	p := &Poller{h: h, i: interval, log: log, m: metrics.NewSet()}
+	for _, t := range targets {
+		t = strings.Trim(t, "/")
+		spl := strings.Split(t, "/")
+		p.t = append(p.t, &pT{
+			d: spl[0],
+			a: spl[1],
+			u: "/api.kobobooks.com/1.0/UpgradeCheck/Device/" + t,
+		})
+	}
+	return p
+}
+
+// Run starts polling each target. The targets are staggered evenly across the
+// interval to avoid a burst of upstream requests.
+func (p *Poller) Run() {
+	for i, t := range p.t {
+		go func(t *pT, delay time.Duration) {
+			time.Sleep(delay)
+			p.run(t)
+		}(t, p.i/time.Duration(len(p.t))*time.Duration(i))
+	}
+}
+
+// run polls t until the program exits. Failed polls are retried with
+// exponential backoff, up to 16x the interval.
+func (p *Poller) run(t *pT) {
+	var fails uint
+	for {
+		if p.poll(t) {
+			atomic.StoreInt64(&t.last, time.Now().Unix())
+			fails = 0
+		} else if fails < 4 {
+			fails++
+		}
+		time.Sleep(p.i << fails)
+	}
+}
+
+func (p *Poller) poll(t *pT) (ok bool) {
+	defer func(st time.Time) {
+		result := "success"
+		if !ok {
+			result = "error"
+		}
+		p.m.GetOrCreateCounter(`kfwproxy_poller_requests_total{device="` + t.d + `",affiliate="` + t.a + `",result="` + result + `"}`).Inc()
+		p.m.GetOrCreateHistogram(`kfwproxy_poller_request_duration_seconds{device="` + t.d + `",affiliate="` + t.a + `"}`).UpdateDuration(st)
+	}(time.Now())
+
+	rq, err := http.NewRequest("GET", t.u, nil)
+	if err != nil {
+		p.log.Err(err).Str("url", t.u).Msg("could not create poll request")
+		return false
+	}
+
+	rc := httptest.NewRecorder()
+	p.h.ServeHTTP(rc, rq)
+
+	if rc.Code != http.StatusOK {
+		p.log.Warn().
+			Str("url", t.u).
+			Int("status", rc.Code).
+			Msg("poll failed")
+		return false
+	}
+
+	p.log.Debug().
+		Str("url", t.u).
+		Str("cached", rc.Header().Get("X-KFWProxy-Cached")).
+		Msg("polled")
+	return true
+}
+
+func (p *Poller) WritePrometheus(w io.Writer) {
+	m := metrics.NewSet()
+	for _, t := range p.t {
+		if last := atomic.LoadInt64(&t.last); last != 0 {
+			m.GetOrCreateGauge(`kfwproxy_poller_last_success_timestamp_seconds{device="`+t.d+`",affiliate="`+t.a+`"}`, func() float64 { return float64(last) })
+		}
+	}
+	m.WritePrometheus(w)
+	p.m.WritePrometheus(w)
+}
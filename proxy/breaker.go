@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// ErrBreakerOpen is returned by Breaker.Do if the circuit is open.
+var ErrBreakerOpen = errors.New("circuit breaker open")
+
+// Breaker is a simple circuit breaker. After Threshold consecutive failures,
+// it opens for Cooldown, after which a single probe request is allowed through
+// (half-open). If the probe succeeds, it closes again, otherwise it re-opens
+// for another Cooldown.
+type Breaker struct {
+	Name      string        // required, used for the metrics
+	Threshold int           // optional (default: 5)
+	Cooldown  time.Duration // optional (default: 30s)
+
+	mu      sync.Mutex
+	fails   int
+	until   time.Time
+	probing bool
+	trips   uint64
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// Do calls fn if the circuit is not open, and records the result. If the
+// circuit is open, ErrBreakerOpen is returned without calling fn. If b is nil,
+// fn is always called.
+func (b *Breaker) Do(fn func() error) error {
+	return b.DoContext(context.Background(), fn)
+}
+
+// DoContext is like Do, but if ctx is done when fn fails (e.g. the client went
+// away), the failure isn't counted since it isn't the upstream's fault.
+func (b *Breaker) DoContext(ctx context.Context, fn func() error) error {
+	if b == nil {
+		return fn()
+	}
+	if !b.allow() {
+		return ErrBreakerOpen
+	}
+	err := fn()
+	if err != nil && ctx.Err() != nil {
+		b.release()
+		return err
+	}
+	b.record(err == nil)
+	return err
+}
+
+// release allows another probe without recording a result.
+func (b *Breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state() {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+func (b *Breaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		b.fails, b.until = 0, time.Time{}
+		return
+	}
+	b.fails++
+	if b.fails >= b.threshold() {
+		if b.until.IsZero() || !time.Now().Before(b.until) {
+			b.trips++
+		}
+		b.until = time.Now().Add(b.cooldown())
+	}
+}
+
+// state must be called with mu held.
+func (b *Breaker) state() breakerState {
+	switch {
+	case b.fails < b.threshold():
+		return breakerClosed
+	case time.Now().Before(b.until):
+		return breakerOpen
+	default:
+		return breakerHalfOpen
+	}
+}
+
+func (b *Breaker) threshold() int {
+	if b.Threshold <= 0 {
+		return 5
+	}
+	return b.Threshold
+}
+
+func (b *Breaker) cooldown() time.Duration {
+	if b.Cooldown <= 0 {
+		return time.Second * 30
+	}
+	return b.Cooldown
+}
+
+func (b *Breaker) WritePrometheus(w io.Writer) {
+	b.mu.Lock()
+	st, trips := b.state(), b.trips
+	b.mu.Unlock()
+
+	m := metrics.NewSet()
+	m.NewGauge(`kfwproxy_breaker_state{name="`+b.Name+`"}`, func() float64 { return float64(st) }) // 0=closed, 1=half-open, 2=open
+	m.NewCounter(`kfwproxy_breaker_trips_total{name="` + b.Name + `"}`).Set(trips)
+	m.WritePrometheus(w)
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestBreakerContext(t *testing.T) {
+	b := &Breaker{Name: "test", Threshold: 2}
+	fail := func() error { return errors.New("fail") }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 5; i++ {
+		if err := b.DoContext(ctx, fail); errors.Is(err, ErrBreakerOpen) {
+			t.Fatalf("expected failures with a done context not to open the breaker")
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		b.DoContext(context.Background(), fail)
+	}
+	if err := b.DoContext(context.Background(), fail); !errors.Is(err, ErrBreakerOpen) {
+		t.Errorf("expected upstream failures to open the breaker, got %v", err)
+	}
+}
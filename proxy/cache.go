@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"encoding/json"
+	"hash/maphash"
+	"io"
+	"net/http"
+	"time"
+	"unsafe"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/dgraph-io/ristretto"
+)
+
+// Cache stores responses. Get may return expired entries (if the
+// implementation retains them), so the expiry must be checked by the caller. If
+// the cost passed to Put is <= 0, the implementation's default is used.
+type Cache interface {
+	Put(key string, data []byte, hdr http.Header, ttl time.Duration, cost int64) (exp time.Time, ok bool)
+	Get(key string) (data []byte, hdr http.Header, exp time.Time, ct time.Time, ok bool)
+}
+
+type RistrettoCache struct {
+	r []*ristretto.Cache // shards
+	s maphash.Seed
+
+	// Cost estimates the memory used by an entry. It defaults to
+	// RistrettoEntryCost.
+	Cost func(key string, data []byte, hdr http.Header) int64
+
+	// Retain is how long to keep entries after they expire (e.g. for
+	// revalidation).
+	Retain time.Duration
+}
+
+// RistrettoEntryCost estimates the memory used by a cache entry, including the
+// key, headers, and the entry itself (not just the body), so the cache limit
+// roughly bounds the actual memory usage.
+func RistrettoEntryCost(key string, data []byte, hdr http.Header) int64 {
+	n := int64(len(key) + len(data))
+	n += int64(unsafe.Sizeof(ristrettoEnt{}))
+	for k, vs := range hdr {
+		n += int64(len(k)) + 16 // string header
+		for _, v := range vs {
+			n += int64(len(v)) + 16
+		}
+		n += 24 // slice header
+	}
+	return n
+}
+
+type ristrettoEnt struct {
+	ct, exp time.Time
+	data    []byte
+	hdr     http.Header
+}
+
+// NewRistrettoCache creates a new RistrettoCache limited to maxBytes. If
+// numCounters is <= 0, it is derived from maxBytes. If bufferItems is <= 0, the
+// default of 64 is used.
+//
+// Ristretto recommends setting numCounters to around 10x the number of items
+// expected to be in the cache when full, and bufferItems to 64 unless there is
+// a lot of contention.
+func NewRistrettoCache(maxBytes, numCounters, bufferItems int64) *RistrettoCache {
+	return NewShardedRistrettoCache(maxBytes, numCounters, bufferItems, 1)
+}
+
+// NewShardedRistrettoCache is like NewRistrettoCache, but splits the cache
+// (including maxBytes and numCounters) across the specified number of
+// ristretto instances by the hash of the key to reduce contention. If shards is
+// <= 1, it is the same as NewRistrettoCache. It panics if maxBytes or
+// numCounters is less than shards.
+func NewShardedRistrettoCache(maxBytes, numCounters, bufferItems int64, shards int) *RistrettoCache {
+	if shards < 1 {
+		shards = 1
+	}
+	if numCounters <= 0 {
+		numCounters = DefaultRistrettoCounters(maxBytes)
+	}
+	if bufferItems <= 0 {
+		bufferItems = 64
+	}
+	rc := &RistrettoCache{r: make([]*ristretto.Cache, shards), s: maphash.MakeSeed(), Cost: RistrettoEntryCost}
+	for i := range rc.r {
+		r, err := ristretto.NewCache(&ristretto.Config{
+			NumCounters: numCounters / int64(shards),
+			MaxCost:     maxBytes / int64(shards),
+			BufferItems: bufferItems,
+			Metrics:     true,
+		})
+		if err != nil {
+			panic(err)
+		}
+		rc.r[i] = r
+	}
+	return rc
+}
+
+// DefaultRistrettoCounters returns the number of counters used by
+// NewShardedRistrettoCache for maxBytes if numCounters is <= 0.
+func DefaultRistrettoCounters(maxBytes int64) int64 {
+	// assume ~1KB per item (most upgrade checks are smaller, but release notes are larger)
+	if n := maxBytes / 1000 * 10; n > 10000 {
+		return n
+	}
+	return 10000
+}
+
+// shard returns the shard for a key.
+func (r *RistrettoCache) shard(key string) *ristretto.Cache {
+	if len(r.r) == 1 {
+		return r.r[0]
+	}
+	var h maphash.Hash
+	h.SetSeed(r.s)
+	h.WriteString(key)
+	return r.r[h.Sum64()%uint64(len(r.r))]
+}
+
+// metric sums a metric across the shards.
+func (r *RistrettoCache) metric(fn func(*ristretto.Metrics) uint64) uint64 {
+	var n uint64
+	for _, c := range r.r {
+		n += fn(c.Metrics)
+	}
+	return n
+}
+
+// Put adds an entry to the cache. If the put couldn't be buffered, it returns
+// false. Since ristretto applies buffered puts asynchronously, the entry may
+// still be rejected by the admission policy after it returns true (see
+// kfwproxy_cache_puts_rejected_count), so it should be treated as best-effort.
+func (r *RistrettoCache) Put(key string, data []byte, hdr http.Header, ttl time.Duration, cost int64) (time.Time, bool) {
+	if cost <= 0 {
+		cost = r.Cost(key, data, hdr)
+	}
+	ct := time.Now()
+	exp := ct.Add(ttl)
+	return exp, r.shard(key).SetWithTTL(key, ristrettoEnt{
+		ct:   ct,
+		exp:  exp,
+		data: data,
+		hdr:  hdr,
+	}, cost, ttl+r.Retain)
+}
+
+func (r *RistrettoCache) Get(key string) ([]byte, http.Header, time.Time, time.Time, bool) {
+	if enti, ok := r.shard(key).Get(key); ok {
+		ent := enti.(ristrettoEnt)
+		return ent.data, ent.hdr, ent.exp, ent.ct, true
+	} else {
+		return nil, nil, time.Time{}, time.Time{}, false
+	}
+}
+
+func (r *RistrettoCache) WritePrometheus(w io.Writer) {
+	m := metrics.NewSet()
+	m.NewGauge("kfwproxy_cache_metrics_lag_seconds", func() float64 { return ristrettoMetricsLag.Seconds() })
+	m.NewGauge("kfwproxy_cache_len_count", func() float64 { return float64(int(r.len())) })
+	m.NewGauge("kfwproxy_cache_size_bytes", func() float64 { return float64(int(r.size())) })
+	m.NewGauge("kfwproxy_cache_shards_count", func() float64 { return float64(len(r.r)) })
+	m.NewCounter("kfwproxy_cache_hits_count").Set(r.metric((*ristretto.Metrics).Hits))
+	m.NewCounter("kfwproxy_cache_misses_count").Set(r.metric((*ristretto.Metrics).Misses))
+	m.NewCounter("kfwproxy_cache_puts_count").Set(r.puts())
+	m.NewCounter("kfwproxy_cache_puts_rejected_count").Set(r.metric((*ristretto.Metrics).SetsRejected)) // accepted by Put, but later rejected by the admission policy
+	m.WritePrometheus(w)
+}
+
+func (r *RistrettoCache) len() uint64 {
+	return r.metric((*ristretto.Metrics).KeysAdded) - r.metric((*ristretto.Metrics).KeysEvicted)
+}
+
+func (r *RistrettoCache) size() uint64 {
+	return r.metric((*ristretto.Metrics).CostAdded) - r.metric((*ristretto.Metrics).CostEvicted)
+}
+
+func (r *RistrettoCache) puts() uint64 {
+	return r.metric((*ristretto.Metrics).KeysAdded) + r.metric((*ristretto.Metrics).KeysUpdated)
+}
+
+// HitRatio returns the ratio of cache hits to total lookups.
+func (r *RistrettoCache) HitRatio() float64 {
+	hits, misses := r.metric((*ristretto.Metrics).Hits), r.metric((*ristretto.Metrics).Misses)
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// ristrettoMetricsLag is the maximum amount of time it will take for expired
+// entries to be reflected in the metrics. Ristretto stores the TTLs in 5 second
+// buckets (rounded up), and the previous bucket is cleaned every 2.5 seconds,
+// so expired entries are removed 5-10 seconds after they expire. This isn't
+// configurable in ristretto.
+const ristrettoMetricsLag = time.Second * 10
+
+// StatsHandler is for backwards-compatibility.
+func (r *RistrettoCache) StatsHandler(init time.Time) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		enc.Encode(map[string]interface{}{
+			"since":  init.String(),
+			"for":    time.Now().Sub(init).String(),
+			"len":    int(r.len()),
+			"size":   int(r.size()),
+			"hits":   r.metric((*ristretto.Metrics).Hits),
+			"misses": r.metric((*ristretto.Metrics).Misses),
+			"puts":   r.puts(),
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/rs/zerolog"
+)
+
+// CacheBackend is a Cache which can fail (e.g. an external cache server).
+type CacheBackend interface {
+	PutErr(key string, data []byte, hdr http.Header, ttl time.Duration, cost int64) (exp time.Time, ok bool, err error)
+	GetErr(key string) (data []byte, hdr http.Header, exp time.Time, ct time.Time, ok bool, err error)
+}
+
+// FallbackCache wraps a CacheBackend, falling back to another Cache (usually
+// a RistrettoCache) if the backend returns an error. If Fallback is nil,
+// caching is bypassed while the backend is failing (i.e. the ProxyHandler
+// treats it as a miss and makes the upstream request).
+type FallbackCache struct {
+	Backend  CacheBackend   // required
+	Fallback Cache          // optional
+	Log      zerolog.Logger // required (use zerolog.Nop to disable)
+
+	errs uint64 // atomic
+}
+
+func (f *FallbackCache) Put(key string, data []byte, hdr http.Header, ttl time.Duration, cost int64) (time.Time, bool) {
+	exp, ok, err := f.Backend.PutErr(key, data, hdr, ttl, cost)
+	if err == nil {
+		return exp, ok
+	}
+	atomic.AddUint64(&f.errs, 1)
+	f.Log.Warn().Err(err).Str("key", key).Msg("cache backend put failed, falling back")
+	if f.Fallback == nil {
+		return time.Time{}, false
+	}
+	return f.Fallback.Put(key, data, hdr, ttl, cost)
+}
+
+func (f *FallbackCache) Get(key string) ([]byte, http.Header, time.Time, time.Time, bool) {
+	data, hdr, exp, ct, ok, err := f.Backend.GetErr(key)
+	if err == nil {
+		return data, hdr, exp, ct, ok
+	}
+	atomic.AddUint64(&f.errs, 1)
+	f.Log.Warn().Err(err).Str("key", key).Msg("cache backend get failed, falling back")
+	if f.Fallback == nil {
+		return nil, nil, time.Time{}, time.Time{}, false
+	}
+	return f.Fallback.Get(key)
+}
+
+func (f *FallbackCache) WritePrometheus(w io.Writer) {
+	m := metrics.NewSet()
+	m.NewCounter("kfwproxy_cache_backend_errors_total").Set(atomic.LoadUint64(&f.errs))
+	m.WritePrometheus(w)
+	if p, ok := f.Fallback.(interface{ WritePrometheus(io.Writer) }); ok {
+		p.WritePrometheus(w)
+	}
+}
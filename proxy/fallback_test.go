@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// failingBackend is a CacheBackend which fails while down is set, and
+// otherwise stores entries in a MapCache.
+type failingBackend struct {
+	MapCache
+	down int32 // atomic
+}
+
+func (b *failingBackend) PutErr(key string, data []byte, hdr http.Header, ttl time.Duration, cost int64) (time.Time, bool, error) {
+	if atomic.LoadInt32(&b.down) != 0 {
+		return time.Time{}, false, errors.New("connection refused")
+	}
+	exp, ok := b.Put(key, data, hdr, ttl, cost)
+	return exp, ok, nil
+}
+
+func (b *failingBackend) GetErr(key string) ([]byte, http.Header, time.Time, time.Time, bool, error) {
+	if atomic.LoadInt32(&b.down) != 0 {
+		return nil, nil, time.Time{}, time.Time{}, false, errors.New("connection refused")
+	}
+	data, hdr, exp, ct, ok := b.Get(key)
+	return data, hdr, exp, ct, ok, nil
+}
+
+func TestFallbackCache(t *testing.T) {
+	for _, fallback := range []bool{false, true} {
+		u, n := testUpstream(t, nil)
+
+		be := new(failingBackend)
+		fc := &FallbackCache{Backend: be, Log: zerolog.Nop()}
+		if fallback {
+			fc.Fallback = new(MapCache)
+		}
+		h := testProxy(fc)
+
+		testRequest(h, "GET", u+"/a")
+		if rc := testRequest(h, "GET", u+"/a"); rc.Header().Get("X-KFWProxy-Cached") == "new" {
+			t.Errorf("fallback=%t: expected the backend to be used while up", fallback)
+		}
+		if v := be.Len(); v != 1 {
+			t.Errorf("fallback=%t: expected 1 backend entry, got %d", fallback, v)
+		}
+
+		atomic.StoreInt32(&be.down, 1)
+		for i := 0; i < 2; i++ {
+			rc := testRequest(h, "GET", u+"/b")
+			if rc.Code != http.StatusOK || rc.Body.String() != "ok /b" {
+				t.Errorf("fallback=%t: expected the proxy to keep serving while the backend is down, got %d %q", fallback, rc.Code, rc.Body.String())
+			}
+		}
+		if v, exp := atomic.LoadInt64(n), map[bool]int64{false: 3, true: 2}[fallback]; v != exp {
+			t.Errorf("fallback=%t: expected %d upstream requests, got %d", fallback, exp, v)
+		}
+
+		var buf bytes.Buffer
+		fc.WritePrometheus(&buf)
+		exp := map[bool]string{false: "4", true: "3"}[fallback] // the second get is a fallback hit, so there's no put
+		if !strings.Contains(buf.String(), "kfwproxy_cache_backend_errors_total "+exp+"\n") {
+			t.Errorf("fallback=%t: expected %s backend errors, got metrics %q", fallback, exp, buf.String())
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Limiter limits the number of concurrent upstream requests. It can be shared
+// between ProxyHandlers to make it global.
+type Limiter struct {
+	Name string // required, used for the metrics
+	Max  int    // required
+
+	once    sync.Once
+	sem     chan struct{}
+	m       *metrics.Set
+	wait    *metrics.Histogram
+	waiting int64 // atomic
+}
+
+func (l *Limiter) init() {
+	l.once.Do(func() {
+		l.sem = make(chan struct{}, l.Max)
+		l.m = metrics.NewSet()
+		l.wait = l.m.NewHistogram(`kfwproxy_upstream_wait_duration_seconds{name="` + l.Name + `"}`)
+		l.m.NewGauge(`kfwproxy_upstream_waiting{name="`+l.Name+`"}`, func() float64 { return float64(atomic.LoadInt64(&l.waiting)) })
+		l.m.NewGauge(`kfwproxy_upstream_active{name="`+l.Name+`"}`, func() float64 { return float64(len(l.sem)) })
+	})
+}
+
+// Do waits for a slot, then calls fn while holding it. If ctx is done first,
+// its error is returned without calling fn. If l is nil or Max is <= 0, fn is
+// always called.
+func (l *Limiter) Do(ctx context.Context, fn func() error) error {
+	if l == nil || l.Max <= 0 {
+		return fn()
+	}
+	l.init()
+
+	atomic.AddInt64(&l.waiting, 1)
+	t := time.Now()
+	select {
+	case l.sem <- struct{}{}:
+	case <-ctx.Done():
+		atomic.AddInt64(&l.waiting, -1)
+		l.wait.UpdateDuration(t)
+		return ctx.Err()
+	}
+	atomic.AddInt64(&l.waiting, -1)
+	l.wait.UpdateDuration(t)
+
+	defer func() { <-l.sem }()
+	return fn()
+}
+
+func (l *Limiter) WritePrometheus(w io.Writer) {
+	if l.Max <= 0 {
+		return
+	}
+	l.init()
+	l.m.WritePrometheus(w)
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MapCache is a simple unbounded in-memory Cache, mainly for testing. Expired
+// entries are returned by Get until they are overwritten.
+type MapCache struct {
+	mu sync.Mutex
+	m  map[string]mapCacheEnt
+}
+
+type mapCacheEnt struct {
+	ct, exp time.Time
+	data    []byte
+	hdr     http.Header
+}
+
+func (c *MapCache) Put(key string, data []byte, hdr http.Header, ttl time.Duration, cost int64) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = map[string]mapCacheEnt{}
+	}
+	ct := time.Now()
+	exp := ct.Add(ttl)
+	c.m[key] = mapCacheEnt{ct, exp, data, hdr}
+	return exp, true
+}
+
+func (c *MapCache) Get(key string) ([]byte, http.Header, time.Time, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ent, ok := c.m[key]; ok {
+		return ent.data, ent.hdr, ent.exp, ent.ct, true
+	}
+	return nil, nil, time.Time{}, time.Time{}, false
+}
+
+// Len returns the number of entries in the cache.
+func (c *MapCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.m)
+}
@@ -0,0 +1,570 @@
+// Package proxy implements a caching HTTP proxy handler.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+// ProxyHandler forwards the GET/OPTIONS/HEAD request (everything after the
+// root, use http.StripPrefix if not the base) to the URL and query params
+// passed in the original URL.
+type ProxyHandler struct {
+	// request
+	Client        *http.Client // optional
+	DefaultScheme string       // optional (default: http)
+	PassHeaders   []string     // optional
+	UserAgent     string       // optional
+	Breaker       *Breaker     // optional
+	Limiter       *Limiter     // optional, waited on before the Breaker
+
+	// response
+	KeepHeaders []string // optional (default: Content-Type)
+	Stream      bool     // optional, copy the upstream response directly to the client without buffering (the cache and Hook are not used, and the Client's Timeout only applies until the response headers are received)
+
+	// response transformation, processed immediately before writing the response (i.e. not stored in the cache)
+	Server      string                                                // optional
+	CORS        bool                                                  // optional
+	CORSOrigins []string                                              // optional (default: *)
+	VaryHeaders []string                                              // optional, should include the headers which affect CacheID
+	Hook        func(r *http.Request, contentType string, buf []byte) // optional
+	Delay       func() time.Duration                                  // optional, for testing clients only, delays responses by the returned duration
+
+	// metrics
+	Name    string       // optional, used as the endpoint label
+	Metrics *metrics.Set // optional
+
+	// cache
+	Cache       Cache                                                // optional
+	CacheTTL    time.Duration                                        // optional (default: 1h)
+	CacheID     func(*http.Request) string                           // required if Cache set, passed the user's request, not the upstream one
+	CacheCost   func(key string, data []byte, hdr http.Header) int64 // optional (default: decided by the Cache)
+	CacheWeight float64                                              // optional (default: 1), multiplies the cost (default: RistrettoEntryCost if CacheCost is not set) so entries are more (< 1) or less (> 1) likely to stay in the cache
+	CacheOnly   *Switch                                              // optional, if on, cache misses return 503 instead of making an upstream request (e.g. for maintenance)
+
+	StaleIfError                time.Duration // optional, how long after expiry to serve cache entries if the upstream request fails (the Cache must retain them for at least this long)
+	CacheableStatuses           []int         // optional (default: 200), the upstream statuses to cache (note: for redirects, the Client must not follow them)
+	RespectUpstreamCacheControl bool          // optional, if the upstream response has a Cache-Control max-age, cache it for the smaller of it and CacheTTL
+}
+
+// statusHeader stores the status of cached responses other than 200 OK. It is
+// never sent to the client.
+const statusHeader = "X-Kfwproxy-Status"
+
+// ttlHeader stores the upstream max-age (in seconds) of cached responses if
+// RespectUpstreamCacheControl is set. It is never sent to the client.
+const ttlHeader = "X-Kfwproxy-Ttl"
+
+func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var log zerolog.Logger
+	if hl := hlog.FromRequest(r); hl != nil {
+		log = hl.With().Str("component", "proxy").Logger()
+	} else {
+		log = zerolog.Nop()
+	}
+
+	if r.Method == "OPTIONS" {
+		p.transformHeaders(r, w)
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		log.Warn().Msg("method not allowed")
+		p.transformHeaders(r, w)
+		w.Header().Del("Content-Length")
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if p.Stream {
+		if p.CacheOnly.On() {
+			log.Warn().Msg("streaming, but upstream requests are disabled")
+			p.countRequest("unavailable")
+			p.transformHeaders(r, w)
+			w.Header().Del("Content-Length")
+			w.Header().Set("Retry-After", "300")
+			http.Error(w, "Upstream requests are temporarily disabled for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		p.stream(w, r, log)
+		return
+	}
+
+	var status int
+	var buf []byte
+	var hdr http.Header
+	var cached string
+	var exp time.Time
+
+	var sbuf, ebuf []byte
+	var shdr, ehdr http.Header
+	if p.Cache != nil {
+		gt := time.Now()
+		cbuf, chdr, cexp, ct, ok := p.Cache.Get(p.CacheID(r))
+		if p.Metrics != nil {
+			p.Metrics.GetOrCreateHistogram(`kfwproxy_cache_get_duration_seconds{endpoint="` + p.Name + `"}`).UpdateDuration(gt)
+		}
+		if !ok {
+			// not cached
+		} else if time.Now().Before(cexp) {
+			log.Debug().
+				Time("cache_time", ct).
+				Time("cache_expiry", cexp).
+				Msg("serving from cache")
+			status, buf, hdr = cachedStatus(chdr), cbuf, chdr
+			cached, exp = ct.Format(http.TimeFormat), cexp
+			if p.Metrics != nil {
+				p.Metrics.GetOrCreateHistogram(`kfwproxy_cache_hit_freshness_seconds{endpoint="` + p.Name + `"}`).Update(time.Until(cexp).Seconds())
+			}
+		} else {
+			if chdr.Get("Last-Modified") != "" {
+				log.Debug().
+					Time("cache_time", ct).
+					Time("cache_expiry", cexp).
+					Msg("revalidating expired cache entry")
+				sbuf, shdr = cbuf, chdr
+			}
+			if p.StaleIfError > 0 && time.Now().Before(cexp.Add(p.StaleIfError)) {
+				ebuf, ehdr = cbuf, chdr
+			}
+		}
+	}
+
+	if cached == "" && p.CacheOnly.On() {
+		log.Warn().Msg("not cached, but upstream requests are disabled")
+		p.countRequest("unavailable")
+		p.transformHeaders(r, w)
+		w.Header().Del("Content-Length")
+		w.Header().Set("Retry-After", "300")
+		http.Error(w, "Upstream requests are temporarily disabled for maintenance and the response is not cached", http.StatusServiceUnavailable)
+		return
+	}
+
+	if cached == "" {
+		log.Debug().Msg("making upstream request")
+		var ustatus int
+		var ubuf []byte
+		var uhdr http.Header
+		err := p.Limiter.Do(r.Context(), func() error {
+			return p.Breaker.DoContext(r.Context(), func() (err error) {
+				ustatus, ubuf, uhdr, err = p.upstream(r, shdr.Get("Last-Modified"), log)
+				return err
+			})
+		})
+		if err != nil && ehdr == nil {
+			p.transformHeaders(r, w)
+			w.Header().Del("Content-Length")
+			log.Err(err).Msg("upstream")
+			p.countRequest("error")
+			http.Error(w, fmt.Sprintf("%s: proxy %#v: %v", r.URL.String(), http.StatusText(http.StatusBadGateway), err), http.StatusBadGateway)
+			return
+		}
+		status, buf, hdr = ustatus, ubuf, uhdr
+		if ehdr != nil && (err != nil || ustatus >= 500) {
+			log.Warn().Err(err).Int("upstream_status", ustatus).Msg("upstream failed, serving stale cache entry")
+			status, buf, hdr = cachedStatus(ehdr), ebuf, ehdr
+			cached, exp = "stale", time.Time{}
+		} else if ustatus == http.StatusNotModified && shdr != nil {
+			log.Debug().Msg("upstream not modified, extending cache entry")
+			status, buf, hdr = cachedStatus(shdr), sbuf, shdr
+			if uexp, ok := p.cachePut(r, status, sbuf, shdr); ok {
+				cached, exp = "revalidated", uexp
+			} else {
+				cached, exp = "nospace", time.Now().Add(p.cacheTTL(shdr))
+			}
+		} else if p.cacheable(ustatus) && p.Cache != nil && p.cacheTTL(uhdr) > 0 {
+			// note: the put is best-effort (it may still be rejected after
+			// being accepted), so the Cache-Control is conservative (see below)
+			if uexp, ok := p.cachePut(r, ustatus, ubuf, uhdr); ok {
+				cached, exp = "new", uexp
+			} else {
+				cached, exp = "nospace", time.Now().Add(p.cacheTTL(uhdr))
+			}
+		} else {
+			cached, exp = "no", time.Time{}
+		}
+	}
+
+	log.Info().
+		Int("status", status).
+		Str("cached", cached).
+		Time("expiry", exp).
+		Msg("response")
+
+	for k, v := range hdr {
+		if k != statusHeader && k != ttlHeader {
+			w.Header()[k] = v
+		}
+	}
+	p.transformHeaders(r, w)
+	p.transformResponse(r, hdr.Get("Content-Type"), buf)
+
+	switch cached {
+	case "new", "nospace", "no", "revalidated", "stale":
+		p.countRequest(cached)
+	default:
+		p.countRequest("hit")
+	}
+
+	if p.Metrics != nil {
+		p.Metrics.GetOrCreateHistogram(`kfwproxy_response_size_bytes{endpoint="` + p.Name + `"}`).Update(float64(len(buf)))
+	}
+
+	if p.Delay != nil {
+		select {
+		case <-time.After(p.Delay()):
+		case <-r.Context().Done():
+		}
+	}
+
+	w.Header().Set("X-KFWProxy-Cached", cached)
+	if cached == "no" || cached == "stale" { // no cache available, or already expired
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		if exp.IsZero() {
+			panic("cached, but no expiry!?!")
+		}
+		w.Header().Set("Expires", exp.Format(http.TimeFormat))
+		if p.StaleIfError > 0 && cached != "new" && cached != "nospace" {
+			// only advertise stale-if-error if we know we have the entry
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%.0f, stale-if-error=%.0f", exp.Sub(time.Now()).Seconds(), p.StaleIfError.Seconds()))
+		} else {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%.0f", exp.Sub(time.Now()).Seconds()))
+		}
+	}
+
+	if r.Method == "HEAD" {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(status)
+	} else {
+		w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+		w.WriteHeader(status)
+		w.Write(buf)
+	}
+}
+
+func (p *ProxyHandler) cachePut(r *http.Request, status int, buf []byte, hdr http.Header) (time.Time, bool) {
+	var cost int64
+	id := p.CacheID(r)
+	if status != http.StatusOK {
+		hdr = hdr.Clone()
+		hdr.Set(statusHeader, strconv.Itoa(status))
+	}
+	if p.CacheCost != nil {
+		cost = p.CacheCost(id, buf, hdr)
+	}
+	if p.CacheWeight > 0 && p.CacheWeight != 1 {
+		if cost <= 0 {
+			cost = RistrettoEntryCost(id, buf, hdr)
+		}
+		if cost = int64(float64(cost) * p.CacheWeight); cost < 1 {
+			cost = 1
+		}
+	}
+	if p.Metrics != nil {
+		defer p.Metrics.GetOrCreateHistogram(`kfwproxy_cache_put_duration_seconds{endpoint="` + p.Name + `"}`).UpdateDuration(time.Now())
+	}
+	ttl := p.cacheTTL(hdr)
+	if ttl <= 0 {
+		return time.Time{}, false // upstream said not to cache it
+	}
+	return p.Cache.Put(id, buf, hdr, ttl, cost)
+}
+
+// cacheTTL returns the TTL for a response with the specified (kept) headers.
+func (p *ProxyHandler) cacheTTL(hdr http.Header) time.Duration {
+	ttl := p.CacheTTL
+	if v := hdr.Get(ttlHeader); v != "" {
+		if s, err := strconv.Atoi(v); err == nil {
+			if uttl := time.Duration(s) * time.Second; uttl < ttl {
+				ttl = uttl
+			}
+		}
+	}
+	return ttl
+}
+
+// upstreamMaxAge parses the max-age from a Cache-Control header.
+func upstreamMaxAge(cc string) (int, bool) {
+	for _, ccs := range strings.Split(cc, ",") {
+		if ccs = strings.TrimSpace(ccs); strings.HasPrefix(ccs, "max-age=") {
+			if s, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(ccs, "max-age="))); err == nil {
+				return s, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// cacheable checks whether responses with the specified status should be
+// cached.
+func (p *ProxyHandler) cacheable(status int) bool {
+	if p.CacheableStatuses == nil {
+		return status == http.StatusOK
+	}
+	for _, s := range p.CacheableStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedStatus returns the status of a cached response.
+func cachedStatus(hdr http.Header) int {
+	if v := hdr.Get(statusHeader); v != "" {
+		if s, err := strconv.Atoi(v); err == nil {
+			return s
+		}
+	}
+	return http.StatusOK
+}
+
+// countRequest increments the request counter for the specified cache outcome.
+func (p *ProxyHandler) countRequest(outcome string) {
+	if p.Metrics != nil {
+		p.Metrics.GetOrCreateCounter(`kfwproxy_requests_total{endpoint="` + p.Name + `",cache_outcome="` + outcome + `"}`).Inc()
+	}
+}
+
+// upstream makes the upstream request. If ims is not empty, it is sent as the
+// If-Modified-Since header.
+func (p *ProxyHandler) upstream(r *http.Request, ims string, log zerolog.Logger) (int, []byte, http.Header, error) {
+	resp, err := p.upstreamResponse(p.Client, r, "GET", ims, log)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("read upstream response for %#v: %w", resp.Request.URL.String(), err)
+	}
+
+	return resp.StatusCode, buf, p.keepHeaders(resp), nil
+}
+
+// upstreamResponse sends the upstream request using c (or the default client if
+// nil). The body must be closed.
+func (p *ProxyHandler) upstreamResponse(c *http.Client, r *http.Request, method, ims string, log zerolog.Logger) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimLeft(r.URL.Path, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("extract upstream URL from %#v: %w", r.URL, err)
+	}
+	u.RawQuery = r.URL.RawQuery
+
+	if u.Scheme == "" {
+		if p.DefaultScheme == "" {
+			u.Scheme = "http"
+		} else {
+			u.Scheme = p.DefaultScheme
+		}
+	}
+
+	nr, err := http.NewRequestWithContext(r.Context(), method, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create upstream request %#v: %w", u.String(), err)
+	}
+
+	for _, k := range p.PassHeaders {
+		if v := r.Header.Values(k); v != nil {
+			nr.Header[k] = v
+		}
+	}
+	if p.UserAgent != "" {
+		nr.Header.Set("User-Agent", p.UserAgent)
+	}
+	if ims != "" {
+		nr.Header.Set("If-Modified-Since", ims)
+	}
+
+	log.Debug().
+		Str("method", nr.Method).
+		Str("url", nr.URL.String()).
+		Msg("sending upstream request")
+
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(nr)
+	if err != nil {
+		return nil, fmt.Errorf("do upstream request to %#v: %w", u.String(), err)
+	}
+	return resp, nil
+}
+
+// keepHeaders returns the headers to keep from the upstream response.
+func (p *ProxyHandler) keepHeaders(resp *http.Response) http.Header {
+	hdr := make(http.Header)
+	if p.KeepHeaders == nil { // len(0) is different
+		hdr["Content-Type"] = resp.Header.Values("Content-Type")
+	} else {
+		for _, k := range p.KeepHeaders {
+			hdr[k] = resp.Header.Values(k)
+		}
+	}
+	if v := resp.Header.Values("Last-Modified"); v != nil {
+		hdr["Last-Modified"] = v // for revalidation
+	}
+	if v := resp.Header.Values("Location"); v != nil && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		hdr["Location"] = v // for redirects
+	}
+	if p.RespectUpstreamCacheControl {
+		if s, ok := upstreamMaxAge(resp.Header.Get("Cache-Control")); ok {
+			hdr.Set(ttlHeader, strconv.Itoa(s))
+		}
+	}
+	return hdr
+}
+
+// stream copies the upstream response directly to the client.
+func (p *ProxyHandler) stream(w http.ResponseWriter, r *http.Request, log zerolog.Logger) {
+	method := "GET"
+	if r.Method == "HEAD" {
+		method = "HEAD" // since we aren't caching it, there's no need to get the body
+	}
+
+	// the client timeout would also apply to reading the body, so only apply
+	// it until the headers are received
+	c := http.DefaultClient
+	if p.Client != nil {
+		c = p.Client
+	}
+	timeout := c.Timeout
+	if timeout > 0 {
+		cc := *c
+		cc.Timeout = 0
+		c = &cc
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	var resp *http.Response
+	err := p.Limiter.Do(r.Context(), func() error {
+		return p.Breaker.DoContext(r.Context(), func() (err error) {
+			var t *time.Timer
+			if timeout > 0 {
+				t = time.AfterFunc(timeout, cancel)
+			}
+			resp, err = p.upstreamResponse(c, r.WithContext(ctx), method, "", log)
+			if t != nil && !t.Stop() && err == nil {
+				resp.Body.Close()
+				resp, err = nil, fmt.Errorf("timed out waiting for upstream response headers")
+			}
+			return err
+		})
+	})
+	if err != nil {
+		p.transformHeaders(r, w)
+		w.Header().Del("Content-Length")
+		log.Err(err).Msg("upstream")
+		p.countRequest("error")
+		http.Error(w, fmt.Sprintf("%s: proxy %#v: %v", r.URL.String(), http.StatusText(http.StatusBadGateway), err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	log.Info().
+		Int("status", resp.StatusCode).
+		Str("cached", "stream").
+		Msg("response")
+
+	for k, v := range p.keepHeaders(resp) {
+		w.Header()[k] = v
+	}
+	p.transformHeaders(r, w)
+	p.countRequest("stream")
+
+	w.Header().Set("X-KFWProxy-Cached", "stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if r.Method != "HEAD" {
+		n, err := io.Copy(w, resp.Body)
+		if err != nil {
+			log.Err(err).Msg("copy upstream response")
+		}
+		if p.Metrics != nil {
+			p.Metrics.GetOrCreateHistogram(`kfwproxy_response_size_bytes{endpoint="` + p.Name + `"}`).Update(float64(n))
+		}
+	}
+}
+
+func (p *ProxyHandler) transformHeaders(r *http.Request, w http.ResponseWriter) {
+	if p.Server != "" {
+		w.Header().Add("Server", p.Server)
+	}
+	if len(p.VaryHeaders) != 0 {
+		w.Header().Add("Vary", strings.Join(p.VaryHeaders, ", "))
+	}
+	if p.CORS {
+		SetCORSOrigin(w, r, p.CORSOrigins)
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+		w.Header().Set("Access-Control-Expose-Headers", "X-KFWProxy-Request-ID, X-KFWProxy-Cached")
+	}
+}
+
+func (p *ProxyHandler) transformResponse(r *http.Request, contentType string, buf []byte) {
+	if p.Hook != nil {
+		p.Hook(r, contentType, buf)
+	}
+}
+
+// Switch is a boolean which can be safely changed while in use.
+type Switch struct {
+	v int32
+}
+
+// Set turns the switch on or off.
+func (s *Switch) Set(on bool) {
+	if on {
+		atomic.StoreInt32(&s.v, 1)
+	} else {
+		atomic.StoreInt32(&s.v, 0)
+	}
+}
+
+// On checks whether the switch is on. A nil Switch is always off.
+func (s *Switch) On() bool {
+	return s != nil && atomic.LoadInt32(&s.v) != 0
+}
+
+// SetCORSOrigin sets the Access-Control-Allow-Origin header to * if origins is
+// empty or contains *, or to the request's Origin if it is in origins. If the
+// origin isn't allowed, the header is not set.
+func SetCORSOrigin(w http.ResponseWriter, r *http.Request, origins []string) {
+	if len(origins) == 0 {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	o := r.Header.Get("Origin")
+	for _, a := range origins {
+		if a == "*" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			return
+		}
+		if o != "" && a == o {
+			w.Header().Set("Access-Control-Allow-Origin", o)
+			w.Header().Add("Vary", "Origin")
+			return
+		}
+	}
+	w.Header().Add("Vary", "Origin")
+}
@@ -0,0 +1,377 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rejectCache is a Cache which never stores anything.
+type rejectCache struct{}
+
+func (rejectCache) Put(key string, data []byte, hdr http.Header, ttl time.Duration, cost int64) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (rejectCache) Get(key string) ([]byte, http.Header, time.Time, time.Time, bool) {
+	return nil, nil, time.Time{}, time.Time{}, false
+}
+
+// testUpstream starts an upstream server which responds with the status for the
+// path (default: 200) and "ok <path>", and returns the path prefix to request it
+// through a ProxyHandler and the number of requests made to it.
+func testUpstream(t *testing.T, status map[string]int) (string, *int64) {
+	var n int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&n, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Upstream", "1")
+		if s, ok := status[r.URL.Path]; ok {
+			w.WriteHeader(s)
+		}
+		w.Write([]byte("ok " + r.URL.Path))
+	}))
+	t.Cleanup(srv.Close)
+	return "/" + srv.URL, &n
+}
+
+func testProxy(c Cache) *ProxyHandler {
+	return &ProxyHandler{
+		Server:   "test",
+		CORS:     true,
+		Cache:    c,
+		CacheTTL: time.Hour,
+		CacheID:  func(r *http.Request) string { return r.URL.String() },
+	}
+}
+
+func testRequest(h http.Handler, method, u string) *httptest.ResponseRecorder {
+	rc := httptest.NewRecorder()
+	h.ServeHTTP(rc, httptest.NewRequest(method, u, nil))
+	return rc
+}
+
+// checkMaxAge checks that the Cache-Control max-age is within a few seconds of
+// ttl and that Expires is consistent with it.
+func checkMaxAge(t *testing.T, rc *httptest.ResponseRecorder, ttl time.Duration) {
+	t.Helper()
+	cc := rc.Header().Get("Cache-Control")
+	if !strings.HasPrefix(cc, "max-age=") {
+		t.Errorf("expected max-age in Cache-Control, got %q", cc)
+		return
+	}
+	if ma, err := strconv.Atoi(strings.TrimPrefix(cc, "max-age=")); err != nil {
+		t.Errorf("invalid max-age in Cache-Control %q", cc)
+	} else if d := time.Duration(ma) * time.Second; d > ttl || d < ttl-time.Second*5 {
+		t.Errorf("expected max-age around %s, got %s", ttl, d)
+	}
+	if exp, err := http.ParseTime(rc.Header().Get("Expires")); err != nil {
+		t.Errorf("invalid Expires %q: %v", rc.Header().Get("Expires"), err)
+	} else if d := time.Until(exp); d > ttl+time.Second || d < ttl-time.Second*5 {
+		t.Errorf("expected Expires around %s from now, got %s", ttl, d)
+	}
+}
+
+func TestProxyHandlerCache(t *testing.T) {
+	u, n := testUpstream(t, nil)
+	c := new(MapCache)
+	h := testProxy(c)
+
+	rc := testRequest(h, "GET", u+"/a")
+	if rc.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rc.Code)
+	}
+	if v := rc.Body.String(); v != "ok /a" {
+		t.Errorf("expected body %q, got %q", "ok /a", v)
+	}
+	if v := rc.Header().Get("X-KFWProxy-Cached"); v != "new" {
+		t.Errorf("expected X-KFWProxy-Cached new, got %q", v)
+	}
+	if v := rc.Header().Get("Content-Type"); v != "text/plain" {
+		t.Errorf("expected Content-Type to be kept, got %q", v)
+	}
+	if v := rc.Header().Get("X-Upstream"); v != "" {
+		t.Errorf("expected X-Upstream not to be kept, got %q", v)
+	}
+	if v := rc.Header().Get("Server"); v != "test" {
+		t.Errorf("expected Server test, got %q", v)
+	}
+	if v := rc.Header().Get("Access-Control-Allow-Origin"); v != "*" {
+		t.Errorf("expected Access-Control-Allow-Origin *, got %q", v)
+	}
+	checkMaxAge(t, rc, time.Hour)
+
+	rc = testRequest(h, "GET", u+"/a")
+	if rc.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rc.Code)
+	}
+	if v := rc.Body.String(); v != "ok /a" {
+		t.Errorf("expected cached body %q, got %q", "ok /a", v)
+	}
+	if v := rc.Header().Get("X-KFWProxy-Cached"); v == "" || v == "new" || v == "no" {
+		t.Errorf("expected X-KFWProxy-Cached to be the cache time, got %q", v)
+	} else if _, err := http.ParseTime(v); err != nil {
+		t.Errorf("expected X-KFWProxy-Cached to be the cache time, got %q", v)
+	}
+	checkMaxAge(t, rc, time.Hour)
+
+	if v := atomic.LoadInt64(n); v != 1 {
+		t.Errorf("expected 1 upstream request, got %d", v)
+	}
+
+	testRequest(h, "GET", u+"/b")
+	if v := atomic.LoadInt64(n); v != 2 {
+		t.Errorf("expected 2 upstream requests for a different path, got %d", v)
+	}
+	if v := c.Len(); v != 2 {
+		t.Errorf("expected 2 cache entries, got %d", v)
+	}
+}
+
+func TestProxyHandlerCacheExpiry(t *testing.T) {
+	u, n := testUpstream(t, nil)
+	h := testProxy(new(MapCache))
+	h.CacheTTL = time.Millisecond * 50
+
+	if rc := testRequest(h, "GET", u+"/a"); rc.Header().Get("X-KFWProxy-Cached") != "new" {
+		t.Errorf("expected X-KFWProxy-Cached new, got %q", rc.Header().Get("X-KFWProxy-Cached"))
+	}
+	time.Sleep(time.Millisecond * 100)
+	if rc := testRequest(h, "GET", u+"/a"); rc.Header().Get("X-KFWProxy-Cached") != "new" {
+		t.Errorf("expected expired entry to be replaced, got X-KFWProxy-Cached %q", rc.Header().Get("X-KFWProxy-Cached"))
+	}
+	if v := atomic.LoadInt64(n); v != 2 {
+		t.Errorf("expected 2 upstream requests, got %d", v)
+	}
+}
+
+func TestProxyHandlerNotCacheable(t *testing.T) {
+	u, n := testUpstream(t, map[string]int{"/missing": http.StatusNotFound})
+	c := new(MapCache)
+	h := testProxy(c)
+
+	for i := 0; i < 2; i++ {
+		rc := testRequest(h, "GET", u+"/missing")
+		if rc.Code != http.StatusNotFound {
+			t.Errorf("expected upstream status 404, got %d", rc.Code)
+		}
+		if v := rc.Header().Get("X-KFWProxy-Cached"); v != "no" {
+			t.Errorf("expected X-KFWProxy-Cached no, got %q", v)
+		}
+		if v := rc.Header().Get("Cache-Control"); v != "no-cache" {
+			t.Errorf("expected Cache-Control no-cache, got %q", v)
+		}
+		if v := rc.Header().Get("Expires"); v != "" {
+			t.Errorf("expected no Expires, got %q", v)
+		}
+	}
+	if v := atomic.LoadInt64(n); v != 2 {
+		t.Errorf("expected 2 upstream requests, got %d", v)
+	}
+	if v := c.Len(); v != 0 {
+		t.Errorf("expected no cache entries, got %d", v)
+	}
+
+	h.CacheableStatuses = []int{http.StatusOK, http.StatusNotFound}
+	testRequest(h, "GET", u+"/missing")
+	rc := testRequest(h, "GET", u+"/missing")
+	if rc.Code != http.StatusNotFound {
+		t.Errorf("expected cached status 404, got %d", rc.Code)
+	}
+	if v := rc.Header().Get(statusHeader); v != "" {
+		t.Errorf("expected internal status header to be removed, got %q", v)
+	}
+	if v := atomic.LoadInt64(n); v != 3 {
+		t.Errorf("expected 3 upstream requests, got %d", v)
+	}
+}
+
+func TestProxyHandlerNoSpace(t *testing.T) {
+	u, n := testUpstream(t, nil)
+	h := testProxy(rejectCache{})
+
+	rc := testRequest(h, "GET", u+"/a")
+	if rc.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rc.Code)
+	}
+	if v := rc.Header().Get("X-KFWProxy-Cached"); v != "nospace" {
+		t.Errorf("expected X-KFWProxy-Cached nospace, got %q", v)
+	}
+	checkMaxAge(t, rc, time.Hour)
+
+	testRequest(h, "GET", u+"/a")
+	if v := atomic.LoadInt64(n); v != 2 {
+		t.Errorf("expected 2 upstream requests, got %d", v)
+	}
+}
+
+func TestProxyHandlerNoCache(t *testing.T) {
+	u, _ := testUpstream(t, nil)
+	h := testProxy(nil)
+
+	rc := testRequest(h, "GET", u+"/a")
+	if rc.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rc.Code)
+	}
+	if v := rc.Header().Get("X-KFWProxy-Cached"); v != "no" {
+		t.Errorf("expected X-KFWProxy-Cached no, got %q", v)
+	}
+	if v := rc.Header().Get("Cache-Control"); v != "no-cache" {
+		t.Errorf("expected Cache-Control no-cache, got %q", v)
+	}
+}
+
+func TestProxyHandlerMethods(t *testing.T) {
+	u, n := testUpstream(t, nil)
+	h := testProxy(new(MapCache))
+
+	rc := testRequest(h, "OPTIONS", u+"/a")
+	if rc.Code != http.StatusOK {
+		t.Errorf("OPTIONS: expected status 200, got %d", rc.Code)
+	}
+	if v := rc.Header().Get("Access-Control-Allow-Methods"); v != "GET, HEAD, OPTIONS" {
+		t.Errorf("OPTIONS: expected Access-Control-Allow-Methods, got %q", v)
+	}
+	if v := rc.Header().Get("Content-Length"); v != "0" {
+		t.Errorf("OPTIONS: expected Content-Length 0, got %q", v)
+	}
+	if v := atomic.LoadInt64(n); v != 0 {
+		t.Errorf("OPTIONS: expected no upstream requests, got %d", v)
+	}
+
+	rc = testRequest(h, "HEAD", u+"/a")
+	if rc.Code != http.StatusOK {
+		t.Errorf("HEAD: expected status 200, got %d", rc.Code)
+	}
+	if v := rc.Body.Len(); v != 0 {
+		t.Errorf("HEAD: expected no body, got %d bytes", v)
+	}
+	if v := rc.Header().Get("X-KFWProxy-Cached"); v != "new" {
+		t.Errorf("HEAD: expected X-KFWProxy-Cached new, got %q", v)
+	}
+	if rc = testRequest(h, "GET", u+"/a"); rc.Body.String() != "ok /a" {
+		t.Errorf("HEAD: expected response to be cached for GET, got body %q", rc.Body.String())
+	}
+	if v := atomic.LoadInt64(n); v != 1 {
+		t.Errorf("HEAD: expected 1 upstream request, got %d", v)
+	}
+
+	rc = testRequest(h, "POST", u+"/a")
+	if rc.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: expected status 405, got %d", rc.Code)
+	}
+	if v := rc.Header().Get("Allow"); v != "GET, HEAD, OPTIONS" {
+		t.Errorf("POST: expected Allow header, got %q", v)
+	}
+	if v := atomic.LoadInt64(n); v != 1 {
+		t.Errorf("POST: expected no more upstream requests, got %d", v)
+	}
+}
+
+func TestProxyHandlerUpstreamCacheControl(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, "+strings.TrimPrefix(r.URL.Path, "/"))
+		w.Write([]byte("ok " + r.URL.Path))
+	}))
+	t.Cleanup(srv.Close)
+	u := "/" + srv.URL
+
+	h := testProxy(new(MapCache))
+	checkMaxAge(t, testRequest(h, "GET", u+"/max-age=60"), time.Hour)
+
+	h.RespectUpstreamCacheControl = true
+	rc := testRequest(h, "GET", u+"/max-age=120")
+	checkMaxAge(t, rc, time.Minute*2)
+	if v := rc.Header().Get(ttlHeader); v != "" {
+		t.Errorf("expected internal TTL header to be removed, got %q", v)
+	}
+	checkMaxAge(t, testRequest(h, "GET", u+"/max-age=120"), time.Minute*2)
+	checkMaxAge(t, testRequest(h, "GET", u+"/max-age=86400"), time.Hour)
+
+	if rc := testRequest(h, "GET", u+"/max-age=0"); rc.Header().Get("X-KFWProxy-Cached") != "no" {
+		t.Errorf("expected max-age=0 not to be cached, got X-KFWProxy-Cached %q", rc.Header().Get("X-KFWProxy-Cached"))
+	}
+}
+
+func TestProxyHandlerStream(t *testing.T) {
+	var n int64
+	var m atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&n, 1)
+		m.Store(r.Method)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(len("ok "+r.URL.Path)))
+		w.Write([]byte("ok " + r.URL.Path))
+	}))
+	t.Cleanup(srv.Close)
+	u := "/" + srv.URL
+
+	h := testProxy(new(MapCache))
+	h.Stream = true
+
+	for i := 1; i <= 2; i++ {
+		rc := testRequest(h, "GET", u+"/a")
+		if rc.Code != http.StatusOK || rc.Body.String() != "ok /a" {
+			t.Errorf("GET: expected status 200 and body %q, got %d %q", "ok /a", rc.Code, rc.Body.String())
+		}
+		if v := rc.Header().Get("X-KFWProxy-Cached"); v != "stream" {
+			t.Errorf("GET: expected X-KFWProxy-Cached stream, got %q", v)
+		}
+		if v := rc.Header().Get("Cache-Control"); v != "no-cache" {
+			t.Errorf("GET: expected Cache-Control no-cache, got %q", v)
+		}
+		if v := atomic.LoadInt64(&n); v != int64(i) {
+			t.Errorf("GET: expected %d upstream requests (not cached), got %d", i, v)
+		}
+	}
+
+	rc := testRequest(h, "HEAD", u+"/a")
+	if rc.Code != http.StatusOK {
+		t.Errorf("HEAD: expected status 200, got %d", rc.Code)
+	}
+	if v := rc.Body.Len(); v != 0 {
+		t.Errorf("HEAD: expected no body, got %d bytes", v)
+	}
+	if v := rc.Header().Get("Content-Length"); v != "5" {
+		t.Errorf("HEAD: expected upstream Content-Length, got %q", v)
+	}
+	if v, _ := m.Load().(string); v != "HEAD" {
+		t.Errorf("HEAD: expected upstream HEAD request, got %q", v)
+	}
+}
+
+func TestProxyHandlerStreamTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-headers" {
+			time.Sleep(time.Millisecond * 300)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for i := 0; i < 3; i++ {
+			time.Sleep(time.Millisecond * 100)
+			w.Write([]byte("ok"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(srv.Close)
+	u := "/" + srv.URL
+
+	h := testProxy(nil)
+	h.Stream = true
+	h.Client = &http.Client{Timeout: time.Millisecond * 150}
+
+	if rc := testRequest(h, "GET", u+"/slow-body"); rc.Code != http.StatusOK || rc.Body.String() != "okokok" {
+		t.Errorf("expected the timeout not to apply to the body, got %d %q", rc.Code, rc.Body.String())
+	}
+	if h.Client.Timeout != time.Millisecond*150 {
+		t.Errorf("expected the client not to be modified")
+	}
+	if rc := testRequest(h, "GET", u+"/slow-headers"); rc.Code != http.StatusBadGateway {
+		t.Errorf("expected the timeout to apply to the headers, got %d", rc.Code)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// RuntimeMetrics exposes runtime and process metrics (goroutines, GC, memory)
+// and the number of open connections made by the counted transports.
+type RuntimeMetrics struct {
+	conns int64 // atomic
+}
+
+// Transport returns a new http.Transport (with the same settings as
+// http.DefaultTransport) which counts its open connections.
+func (rm *RuntimeMetrics) Transport() *http.Transport {
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&rm.conns, 1)
+		return &countedConn{Conn: c, n: &rm.conns}, nil
+	}
+	return t
+}
+
+type countedConn struct {
+	net.Conn
+	n      *int64
+	closed int32
+}
+
+func (c *countedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(c.n, -1)
+	}
+	return c.Conn.Close()
+}
+
+func (rm *RuntimeMetrics) WritePrometheus(w io.Writer) {
+	m := metrics.NewSet()
+	m.NewGauge("kfwproxy_goroutines", func() float64 { return float64(runtime.NumGoroutine()) })
+	m.NewGauge("kfwproxy_open_upstream_connections", func() float64 { return float64(atomic.LoadInt64(&rm.conns)) })
+	m.WritePrometheus(w)
+	metrics.WriteProcessMetrics(w)
+}
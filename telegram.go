@@ -5,19 +5,30 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 )
 
+// TelegramAPIBase is the base URL of the official Telegram Bot API.
+const TelegramAPIBase = "https://api.telegram.org"
+
 type Telegram struct {
 	c *http.Client
+	b string
 	t string
 	u string
 }
 
-func NewTelegram(c *http.Client, token string) (*Telegram, error) {
-	tc := &Telegram{c: c, t: token}
+// NewTelegram creates a new Telegram bot client using the Bot API at base
+// (TelegramAPIBase if empty).
+func NewTelegram(c *http.Client, base, token string) (*Telegram, error) {
+	tc := &Telegram{c: c, b: strings.TrimRight(base, "/"), t: token}
 	if tc.c == nil {
 		tc.c = http.DefaultClient
 	}
+	if tc.b == "" {
+		tc.b = TelegramAPIBase
+	}
 	var obj struct {
 		Username string `json:"username"`
 	}
@@ -33,37 +44,90 @@ func (tc *Telegram) GetUsername() string {
 	return tc.u
 }
 
-func (tc *Telegram) GetChatUsername(id string) (string, error) {
+// GetChat resolves a chat ID or @username to the numeric chat ID, and gets a
+// distinct name for it. This is the username if it has one, or the title
+// followed by the ID in parentheses (private chats and groups don't have
+// usernames).
+func (tc *Telegram) GetChat(id string) (int64, string, error) {
 	var obj struct {
+		ID       int64  `json:"id"`
 		Username string `json:"username"`
+		Title    string `json:"title"`
 	}
 	if err := tc.api("getChat", url.Values{
 		"chat_id": {id},
 	}, &obj); err != nil {
-		return "", fmt.Errorf("get chat %#v: %w", id, err)
+		return 0, "", fmt.Errorf("get chat %#v: %w", id, err)
+	}
+	if obj.Username != "" {
+		return obj.ID, obj.Username, nil
 	}
-	return obj.Username, nil
+	if obj.Title != "" {
+		return obj.ID, fmt.Sprintf("%s (%d)", obj.Title, obj.ID), nil
+	}
+	return obj.ID, strconv.FormatInt(obj.ID, 10), nil
 }
 
 func (tc *Telegram) SendMessage(id, text string) error {
-	if err := tc.api("sendMessage", url.Values{
+	return tc.SendMessageWithButtons(id, text, "HTML", false, nil)
+}
+
+// TelegramButton is an inline keyboard button which opens a URL.
+type TelegramButton struct {
+	Text string `json:"text"`
+	URL  string `json:"url"`
+}
+
+// SendMessageWithButtons sends a message formatted with parseMode (HTML or
+// MarkdownV2) with a row of inline keyboard buttons below it. If linkPreview is
+// true, Telegram shows a preview of the first link in the message.
+func (tc *Telegram) SendMessageWithButtons(id, text, parseMode string, linkPreview bool, buttons []TelegramButton) error {
+	params := url.Values{
 		"chat_id":                  {id},
 		"text":                     {text},
-		"parse_mode":               {"HTML"},
-		"disable_web_page_preview": {"true"},
-	}, nil); err != nil {
+		"parse_mode":               {parseMode},
+		"disable_web_page_preview": {strconv.FormatBool(!linkPreview)},
+	}
+	if len(buttons) != 0 {
+		buf, err := json.Marshal(map[string]interface{}{
+			"inline_keyboard": [][]TelegramButton{buttons},
+		})
+		if err != nil {
+			return fmt.Errorf("send message to %#v: encode reply markup: %w", id, err)
+		}
+		params.Set("reply_markup", string(buf))
+	}
+	if err := tc.api("sendMessage", params, nil); err != nil {
 		return fmt.Errorf("send message to %#v: %w", id, err)
 	}
 	return nil
 }
 
+var telegramMarkdownV2Escaper = strings.NewReplacer(
+	"\\", "\\\\", "_", "\\_", "*", "\\*", "[", "\\[", "]", "\\]", "(", "\\(", ")", "\\)",
+	"~", "\\~", "`", "\\`", ">", "\\>", "#", "\\#", "+", "\\+", "-", "\\-", "=", "\\=",
+	"|", "\\|", "{", "\\{", "}", "\\}", ".", "\\.", "!", "\\!",
+)
+
+// TelegramEscapeMarkdownV2 escapes the reserved characters in s for use in a
+// MarkdownV2 message.
+func TelegramEscapeMarkdownV2(s string) string {
+	return telegramMarkdownV2Escaper.Replace(s)
+}
+
+// TelegramEscapeMarkdownV2URL escapes s for use as the URL of a MarkdownV2
+// inline link.
+func TelegramEscapeMarkdownV2URL(s string) string {
+	return strings.NewReplacer("\\", "\\\\", ")", "\\)").Replace(s)
+}
+
 func (tc *Telegram) api(method string, params url.Values, out interface{}) error {
 	var p string
 	if params != nil {
 		p = "?" + params.Encode()
 	}
 
-	req, err := http.NewRequest("GET", "https://api.telegram.org/bot"+tc.t+"/"+method+p, nil)
+	req, err := http.NewRequest("GET", tc.b+"/bot"+tc.t+"/"+method+p, nil)
 	if err != nil {
 		return fmt.Errorf("create request: %w", err)
 	}